@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// upstreamHealth polls the upstream health endpoint. The upstream counts as
+// down after failThreshold failed checks in a row and as up again after one
+// successful check.
+type upstreamHealth struct {
+	url           string
+	client        *http.Client
+	interval      time.Duration
+	failThreshold int
+
+	mu        sync.RWMutex
+	healthy   bool
+	failures  int
+	lastError string
+	checkedAt time.Time
+}
+
+// healthStatus is reported on the edge health endpoint
+type healthStatus struct {
+	Upstream  string    `json:"upstream"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+func newUpstreamHealth(url string, interval, timeout time.Duration, failThreshold int) *upstreamHealth {
+	return &upstreamHealth{
+		url:           url,
+		client:        &http.Client{Timeout: timeout},
+		interval:      interval,
+		failThreshold: failThreshold,
+		// Assume the upstream is up until checks say otherwise
+		healthy: true,
+	}
+}
+
+// Healthy reports whether the upstream passed its recent checks
+func (h *upstreamHealth) Healthy() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.healthy
+}
+
+// Status returns a snapshot of the health state
+func (h *upstreamHealth) Status() healthStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return healthStatus{
+		Upstream:  h.url,
+		Healthy:   h.healthy,
+		Failures:  h.failures,
+		LastError: h.lastError,
+		CheckedAt: h.checkedAt,
+	}
+}
+
+// Run checks the upstream every interval until ctx is cancelled
+func (h *upstreamHealth) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		h.record(h.check(ctx))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check requests the health endpoint once; any 2xx or 3xx status is healthy
+func (h *upstreamHealth) check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// record updates the state with the result of a check and logs changes
+func (h *upstreamHealth) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checkedAt = time.Now()
+	if err == nil {
+		if !h.healthy {
+			log.Printf("Upstream %s is healthy again", h.url)
+		}
+		h.healthy, h.failures, h.lastError = true, 0, ""
+		return
+	}
+
+	h.failures++
+	h.lastError = err.Error()
+	if h.healthy && h.failures >= h.failThreshold {
+		log.Printf("Upstream %s is unhealthy after %d failed checks: %v", h.url, h.failures, err)
+		h.healthy = false
+	}
+}
@@ -0,0 +1,318 @@
+// Command dkl-edge is a caching, rate limiting reverse proxy in front of the
+// DKL API. It applies the cache route policies and limiters of package
+// middleware without any change to the backend behind it.
+//
+// Usage:
+//
+//	EDGE_UPSTREAM=https://dklemailservice.onrender.com dkl-edge -policies config/cache_policies.json
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jeffreasy/dkl25/backend/lib"
+	"github.com/jeffreasy/dkl25/backend/middleware"
+)
+
+// edgeConfig holds everything newEdge needs
+type edgeConfig struct {
+	Upstream    *url.URL
+	Policies    *middleware.CachePolicyTable
+	RateLimit   int // requests per RateWindow per client and policy route; 0 disables
+	RateWindow  time.Duration
+	RateHeaders bool // IETF RateLimit headers next to the X-RateLimit ones
+	Health      *upstreamHealth
+	Warmer      *middleware.CacheWarmer
+	Diagnostics middleware.DiagnosticsConfig
+	Resolver    *middleware.ClientIPResolver // nil trusts no forwarding headers
+}
+
+func main() {
+	listen := flag.String("listen", envOr("EDGE_LISTEN", ":8081"), "address to listen on")
+	upstream := flag.String("upstream", os.Getenv("EDGE_UPSTREAM"), "base URL of the API")
+	policyFile := flag.String("policies", os.Getenv("EDGE_POLICIES"), "cache policy file; empty uses the built-in policies")
+	rateLimit := flag.Int("rate-limit", 300, "requests per window per client and route; 0 disables")
+	rateWindow := flag.Duration("rate-window", time.Minute, "rate limit window")
+	rateHeaders := flag.Bool("standard-ratelimit-headers", false, "also send the IETF RateLimit-Policy and RateLimit headers")
+	healthPath := flag.String("health-path", "/api/health", "upstream health endpoint")
+	healthInterval := flag.Duration("health-interval", 10*time.Second, "time between health checks")
+	healthTimeout := flag.Duration("health-timeout", 2*time.Second, "health check timeout")
+	healthFailures := flag.Int("health-failures", 3, "failed checks before the upstream counts as down")
+	warmInterval := flag.Duration("warm-interval", 0, "re-warm all policies this often; 0 only warms after invalidation")
+	trustedProxies := flag.String("trusted-proxies", os.Getenv("EDGE_TRUSTED_PROXIES"), "comma separated CIDRs of proxies in front of the edge, e.g. a CDN")
+	forwardedHeader := flag.String("forwarded-header", envOr("EDGE_FORWARDED_HEADER", "X-Forwarded-For"), "header the trusted proxies put the client in: X-Forwarded-For, Forwarded or X-Real-IP")
+	ipv6Prefix := flag.Int("ipv6-prefix", 64, "rate limit IPv6 clients per prefix of this length; 0 per address")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time to finish requests on shutdown")
+	flag.Parse()
+
+	upstreamURL, err := url.Parse(*upstream)
+	if err != nil || upstreamURL.Scheme == "" || upstreamURL.Host == "" {
+		log.Fatalf("Invalid upstream %q: set -upstream or EDGE_UPSTREAM to the API base URL", *upstream)
+	}
+
+	resolver, err := middleware.NewClientIPResolver(
+		slices.Concat(middleware.DefaultTrustedProxies, strings.Split(*trustedProxies, ",")), *ipv6Prefix,
+		middleware.ForwardingHeader(*forwardedHeader))
+	if err != nil {
+		log.Fatalf("Invalid client IP settings: %v", err)
+	}
+	middleware.SetClientIPResolver(resolver)
+
+	if err := lib.InitRedisFromEnv(); err != nil {
+		log.Fatalf("Redis is required: %v", err)
+	}
+	defer lib.CloseRedis()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	policies, err := middleware.NewCachePolicyTable(middleware.DefaultCachePolicies())
+	if *policyFile != "" {
+		policies, err = middleware.LoadCachePolicies(*policyFile)
+		if err == nil {
+			go policies.Watch(ctx, 5*time.Second)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Invalid cache policies: %v", err)
+	}
+	go func() {
+		if err := middleware.PurgeStaleCacheVersions(policies); err != nil {
+			log.Printf("Purging old cache versions failed: %v", err)
+		}
+	}()
+
+	health := newUpstreamHealth(upstreamURL.JoinPath(*healthPath).String(), *healthInterval, *healthTimeout, *healthFailures)
+	go health.Run(ctx)
+
+	// Warm through the edge itself so the responses land in the cache
+	warmer := &middleware.CacheWarmer{BaseURL: localURL(*listen), Policies: policies}
+	if *warmInterval > 0 {
+		go warmer.Run(ctx, *warmInterval)
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("Cannot listen on %s: %v", *listen, err)
+	}
+	server := &http.Server{
+		Handler: newEdge(edgeConfig{
+			Upstream:    upstreamURL,
+			Policies:    policies,
+			RateLimit:   *rateLimit,
+			RateWindow:  *rateWindow,
+			RateHeaders: *rateHeaders,
+			Health:      health,
+			Warmer:      warmer,
+			Diagnostics: middleware.DiagnosticsConfig{Secret: []byte(os.Getenv("DEBUG_SECRET"))},
+			Resolver:    resolver,
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("dkl-edge listening on %s, proxying to %s", *listen, upstreamURL)
+	if err := serve(ctx, server, listener, *shutdownTimeout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve runs the server until ctx is cancelled, then stops accepting
+// connections and gives open requests shutdownTimeout to finish
+func serve(ctx context.Context, server *http.Server, listener net.Listener, shutdownTimeout time.Duration) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("server error: %w", err)
+	case <-ctx.Done():
+		log.Println("Shutting down, finishing open requests...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			return fmt.Errorf("shutdown did not finish cleanly: %w", err)
+		}
+		return nil
+	}
+}
+
+// newEdge builds the edge handler: diagnostics, rate limiting, invalidation
+// and caching around a reverse proxy to the upstream
+func newEdge(config edgeConfig) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(config.Upstream)
+			// Keep the hops added by trusted proxies in front of the edge, such
+			// as a CDN, as X-Forwarded-For; SetXForwarded appends the peer
+			if config.Resolver != nil && config.Resolver.TrustsPeer(pr.In.RemoteAddr) {
+				if hops := config.Resolver.ForwardedHops(pr.In.Header); len(hops) > 0 {
+					pr.Out.Header.Set("X-Forwarded-For", strings.Join(hops, ", "))
+				}
+			}
+			pr.SetXForwarded()
+			// The cache stores uncompressed bodies and compresses them itself,
+			// so cacheable requests must not get an encoded response
+			if cacheable(config.Policies, pr.In) {
+				pr.Out.Header.Del("Accept-Encoding")
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Proxy error for %s %s: %v", r.Method, r.URL.Path, err)
+			http.Error(w, "Upstream unavailable", http.StatusBadGateway)
+		},
+	}
+
+	// WebSocket upgrades pass every layer untouched; ReverseProxy tunnels them
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cacheable(config.Policies, r) {
+			w = bufferedWriter{w}
+		}
+		proxy.ServeHTTP(w, r)
+	})
+	handler = requireHealthyUpstream(config.Health)(handler)
+	handler = middleware.SmartCacheWithPolicies(config.Policies)(handler)
+	handler = invalidateWrites(config.Policies, config.Warmer)(handler)
+	if config.RateLimit > 0 {
+		handler = middleware.RateLimitMiddleware(middleware.RateLimitConfig{
+			Requests:        config.RateLimit,
+			Window:          config.RateWindow,
+			StandardHeaders: config.RateHeaders,
+			Routes:          policyRoutes(config.Policies),
+		})(handler)
+	}
+	handler = middleware.DiagnosticsMiddleware(config.Diagnostics)(handler)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/edge/health", func(w http.ResponseWriter, r *http.Request) {
+		status := config.Health.Status()
+		code := http.StatusOK
+		if !status.Healthy {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(status)
+	})
+	mux.Handle("/", handler)
+	return mux
+}
+
+// cacheable reports whether a request goes through the cache: a GET or HEAD
+// on a policy route that is not a WebSocket upgrade
+func cacheable(policies *middleware.CachePolicyTable, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	_, _, ok := policies.Match(http.MethodGet, r.URL.Path)
+	return ok
+}
+
+// policyRoutes returns the route templates of the cache policies, which the
+// rate limit counts separately; all other paths share one limit per client
+func policyRoutes(policies *middleware.CachePolicyTable) []string {
+	var routes []string
+	for _, policy := range policies.Policies() {
+		for _, route := range policy.Routes {
+			routes = append(routes, route.Path)
+		}
+	}
+	return routes
+}
+
+// bufferedWriter ignores the flushes ReverseProxy makes for responses of
+// unknown length, such as decompressed ones, which would stop the cache from
+// buffering them. Event streams are still flushed.
+type bufferedWriter struct {
+	http.ResponseWriter
+}
+
+func (w bufferedWriter) Flush() {
+	if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w bufferedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// requireHealthyUpstream answers 503 straight away while the upstream is
+// down, instead of letting every request wait for a timeout. It sits behind
+// the cache, so cached responses are still served.
+func requireHealthyUpstream(health *upstreamHealth) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !health.Healthy() {
+				w.Header().Set("Retry-After", strconv.Itoa(int(health.interval.Seconds())))
+				http.Error(w, "Upstream unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// invalidateWrites purges the cache group whose routes match a write, after
+// the upstream accepted it. Route methods are ignored: the policies list
+// GET routes, writes go to the same paths.
+func invalidateWrites(policies *middleware.CachePolicyTable, warmer *middleware.CacheWarmer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			policy, _, ok := policies.Match(http.MethodGet, r.URL.Path)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			routes := make([]string, len(policy.Routes))
+			for i, route := range policy.Routes {
+				routes[i] = route.Path
+			}
+			invalidation := middleware.CacheInvalidationWithConfig(middleware.InvalidationConfig{
+				Groups:       []string{policy.Prefix},
+				Routes:       routes,
+				Dependencies: policies.Dependencies(),
+				Warmer:       warmer,
+			})
+			invalidation(next).ServeHTTP(w, r)
+		})
+	}
+}
+
+// localURL returns the URL the edge can reach itself on
+func localURL(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "http://" + listen
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// envOr returns the environment variable or a default
+func envOr(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/jeffreasy/dkl25/backend/lib"
+	"github.com/jeffreasy/dkl25/backend/middleware"
+)
+
+const photos = `[{"id":1}]`
+
+// testEdge is an edge in front of a stub upstream
+type testEdge struct {
+	*httptest.Server
+	health *upstreamHealth
+	calls  atomic.Int64 // requests that reached the upstream
+}
+
+// newTestEdge starts a stub upstream and an edge with the built-in policies.
+// The upstream answers writes with 204, echoes lines on WebSockets and
+// gzips JSON when the request accepts it.
+func newTestEdge(t *testing.T) *testEdge {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	lib.RedisClient = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	e := &testEdge{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "websocket" {
+			conn, rw, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			rw.Flush()
+			line, _ := rw.ReadString('\n')
+			rw.WriteString("echo " + line)
+			rw.Flush()
+			return
+		}
+		if r.URL.Path != "/api/health" {
+			e.calls.Add(1)
+		}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			gz.Write([]byte(photos))
+			return
+		}
+		w.Write([]byte(photos))
+	}))
+	t.Cleanup(upstream.Close)
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	policies, err := middleware.NewCachePolicyTable(middleware.DefaultCachePolicies())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.health = newUpstreamHealth(upstream.URL+"/api/health", time.Hour, time.Second, 1)
+	e.Server = httptest.NewServer(newEdge(edgeConfig{
+		Upstream:   upstreamURL,
+		Policies:   policies,
+		RateLimit:  100,
+		RateWindow: time.Minute,
+		Health:     e.health,
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+// do sends a request to the edge and returns the response with its body
+func (e *testEdge) do(t *testing.T, method, path string, header map[string]string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, e.URL+path, nil)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestCacheMissThenHit(t *testing.T) {
+	e := newTestEdge(t)
+
+	// The client's Accept-Encoding is not forwarded: a gzipped upstream
+	// response could not be stored
+	for i, want := range []string{"MISS", "HIT"} {
+		resp, body := e.do(t, "GET", "/api/photos/5", map[string]string{"Accept-Encoding": "gzip"})
+		if resp.StatusCode != 200 || resp.Header.Get("X-Cache") != want || body != photos {
+			t.Fatalf("request %d: %d X-Cache %q %q, want 200 %s", i, resp.StatusCode, resp.Header.Get("X-Cache"), body, want)
+		}
+	}
+	resp, _ := e.do(t, "GET", "/api/photos/5", map[string]string{"Accept-Encoding": "gzip"})
+	if resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("gzip client: X-Cache %q, want HIT", resp.Header.Get("X-Cache"))
+	}
+	if calls := e.calls.Load(); calls != 1 {
+		t.Errorf("upstream called %d times, want 1", calls)
+	}
+
+	// Routes without a policy are proxied as they are
+	resp, _ = e.do(t, "GET", "/api/other", map[string]string{"Accept-Encoding": "gzip"})
+	if resp.Header.Get("X-Cache") != "" || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("uncached route: X-Cache %q, Content-Encoding %q", resp.Header.Get("X-Cache"), resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestWebSocketPassThrough(t *testing.T) {
+	e := newTestEdge(t)
+
+	conn, err := net.Dial("tcp", e.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("GET /api/photos HTTP/1.1\r\nHost: edge\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	status, _ := br.ReadString('\n')
+	if !strings.Contains(status, "101") {
+		t.Fatalf("status line %q, want 101", status)
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+
+	conn.Write([]byte("hello\n"))
+	if echo, _ := br.ReadString('\n'); echo != "echo hello\n" {
+		t.Fatalf("echo %q", echo)
+	}
+}
+
+func TestUnhealthyUpstream(t *testing.T) {
+	e := newTestEdge(t)
+	e.do(t, "GET", "/api/photos/5", nil)
+
+	e.health.record(io.EOF)
+	if resp, body := e.do(t, "GET", "/api/photos/5", nil); resp.Header.Get("X-Cache") != "HIT" || body != photos {
+		t.Errorf("cached entry: X-Cache %q %q, want HIT", resp.Header.Get("X-Cache"), body)
+	}
+	resp, _ := e.do(t, "GET", "/api/photos/6", nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("miss: %d Retry-After %q, want 503", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if calls := e.calls.Load(); calls != 1 {
+		t.Errorf("upstream called %d times, want 1", calls)
+	}
+	if resp, body := e.do(t, "GET", "/edge/health", nil); resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, `"healthy":false`) {
+		t.Errorf("health: %d %s", resp.StatusCode, body)
+	}
+
+	// One good check brings it back
+	e.health.record(e.health.check(context.Background()))
+	if resp, _ := e.do(t, "GET", "/api/photos/6", nil); resp.StatusCode != 200 {
+		t.Errorf("after recovery: %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestWriteInvalidates(t *testing.T) {
+	e := newTestEdge(t)
+	e.do(t, "GET", "/api/photos/5", nil)
+
+	resp, _ := e.do(t, "PUT", "/api/photos/5", nil)
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("X-Cache-Invalidated") != "true" {
+		t.Fatalf("write: %d X-Cache-Invalidated %q", resp.StatusCode, resp.Header.Get("X-Cache-Invalidated"))
+	}
+	if resp, _ := e.do(t, "GET", "/api/photos/5", nil); resp.Header.Get("X-Cache") != "MISS" {
+		t.Errorf("after write: X-Cache %q, want MISS", resp.Header.Get("X-Cache"))
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, server, listener, 5*time.Second)
+	}()
+
+	// A request in flight when the shutdown starts still gets its response
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	<-started
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if got := <-body; got != "done" {
+		t.Errorf("open request got %q, want done", got)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Error("still accepting connections after shutdown")
+	}
+}
@@ -0,0 +1,15 @@
+// Package config embeds the configuration files shipped with the backend, so
+// the built-in defaults are the same files ops edit and load at runtime.
+package config
+
+import _ "embed"
+
+// CachePolicies is cache_policies.json, the default cache policies
+//
+//go:embed cache_policies.json
+var CachePolicies []byte
+
+// RoleQuotas is role_quotas.json, the default rate limit quotas per role
+//
+//go:embed role_quotas.json
+var RoleQuotas []byte
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jeffreasy/dkl25/backend/middleware"
+)
+
+// AuthAdminConfig configures the lockout management API
+type AuthAdminConfig struct {
+	Protectors  []*middleware.BruteForceProtector // e.g. login and reset-password
+	Permissions middleware.PermissionChecker      // must grant auth:manage
+}
+
+// AuthAdmin lets admins inspect and lift brute force lockouts
+type AuthAdmin struct {
+	config AuthAdminConfig
+}
+
+// NewAuthAdmin creates the lockout management API
+func NewAuthAdmin(config AuthAdminConfig) *AuthAdmin {
+	return &AuthAdmin{config: config}
+}
+
+// Routes registers the API under prefix (e.g. "/api/admin/auth"), behind the
+// auth:manage permission:
+//
+//	GET  {prefix}/lockout?account=...&ip=...  failures and locks per protector
+//	POST {prefix}/unlock                       unlock {"account": "...", "ip": "..."}
+func (a *AuthAdmin) Routes(mux *http.ServeMux, prefix string) {
+	protect := middleware.RequirePermission(a.config.Permissions, "auth", "manage")
+
+	mux.Handle(prefix+"/lockout", protect(allowMethod(http.MethodGet, a.Lockout)))
+	mux.Handle(prefix+"/unlock", protect(allowMethod(http.MethodPost, a.Unlock)))
+}
+
+// Lockout shows the failures and locks of an account and/or IP
+func (a *AuthAdmin) Lockout(w http.ResponseWriter, r *http.Request) {
+	account, ip := r.URL.Query().Get("account"), r.URL.Query().Get("ip")
+	if account == "" && ip == "" {
+		writeError(w, http.StatusBadRequest, "set account and/or ip")
+		return
+	}
+
+	statuses := []middleware.BruteForceStatus{}
+	for _, protector := range a.config.Protectors {
+		status, err := protector.Status(ip, account)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		statuses = append(statuses, status)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"lockouts": statuses})
+}
+
+// unlockRequest selects what to unlock; at least one field must be set
+type unlockRequest struct {
+	Account string `json:"account,omitempty"`
+	IP      string `json:"ip,omitempty"`
+}
+
+// Unlock lifts the locks of an account and/or IP in every protector
+func (a *AuthAdmin) Unlock(w http.ResponseWriter, r *http.Request) {
+	var req unlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.Account == "" && req.IP == "" {
+		writeError(w, http.StatusBadRequest, "set account and/or ip")
+		return
+	}
+
+	for _, protector := range a.config.Protectors {
+		if err := protector.Unlock(req.IP, req.Account); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"unlocked": req})
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jeffreasy/dkl25/backend/lib"
+	"github.com/jeffreasy/dkl25/backend/middleware"
+)
+
+// CacheAdminConfig configures the cache management API
+type CacheAdminConfig struct {
+	Policies    *middleware.CachePolicyTable // groups that may be listed and purged; nil uses the defaults
+	Permissions middleware.PermissionChecker // must grant cache:manage
+	Warmer      *middleware.CacheWarmer      // used to re-warm; nil disables /warm
+}
+
+// CacheAdmin serves the cache management API for ops. It only touches
+// response cache groups, never sessions or rate limit counters.
+type CacheAdmin struct {
+	config CacheAdminConfig
+}
+
+// NewCacheAdmin creates the cache management API
+func NewCacheAdmin(config CacheAdminConfig) *CacheAdmin {
+	if config.Policies == nil {
+		config.Policies, _ = middleware.NewCachePolicyTable(middleware.DefaultCachePolicies())
+	}
+	return &CacheAdmin{config: config}
+}
+
+// Routes registers the API under prefix (e.g. "/api/admin/cache"), behind the
+// cache:manage permission:
+//
+//	GET  {prefix}/keys?prefix=photos&limit=100  list entries with TTL and size
+//	GET  {prefix}/entry?key=dkl:photos:...       view one entry
+//	POST {prefix}/purge                          purge {"key"|"prefix"|"tag": "..."}
+//	POST {prefix}/warm?prefix=photos             re-warm policy endpoints, returns a report
+//	GET  {prefix}/stats                          hit ratio per cache group
+func (a *CacheAdmin) Routes(mux *http.ServeMux, prefix string) {
+	protect := middleware.RequirePermission(a.config.Permissions, "cache", "manage")
+
+	mux.Handle(prefix+"/keys", protect(allowMethod(http.MethodGet, a.ListKeys)))
+	mux.Handle(prefix+"/entry", protect(allowMethod(http.MethodGet, a.GetEntry)))
+	mux.Handle(prefix+"/purge", protect(allowMethod(http.MethodPost, a.Purge)))
+	mux.Handle(prefix+"/warm", protect(allowMethod(http.MethodPost, a.Warm)))
+	mux.Handle(prefix+"/stats", protect(allowMethod(http.MethodGet, a.Stats)))
+}
+
+// ListKeys lists cache entries of one group, or of all groups without ?prefix
+func (a *CacheAdmin) ListKeys(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > 1000 {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = parsed
+	}
+
+	groups := a.groups()
+	if prefix := r.URL.Query().Get("prefix"); prefix != "" {
+		if !contains(groups, prefix) {
+			writeError(w, http.StatusNotFound, "unknown cache group "+prefix)
+			return
+		}
+		groups = []string{prefix}
+	}
+
+	entries := []lib.KeyInfo{}
+	for _, group := range groups {
+		keys, err := lib.ListKeys(lib.CacheKey(group, "*"), limit-len(entries))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		entries = append(entries, keys...)
+		if len(entries) >= limit {
+			break
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"entries": entries,
+		"count":   len(entries),
+	})
+}
+
+// GetEntry shows one decoded cache entry with its remaining TTL
+func (a *CacheAdmin) GetEntry(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if !a.isCacheKey(key) {
+		writeError(w, http.StatusBadRequest, "key is not in a cache group")
+		return
+	}
+
+	entry, err := middleware.InspectCacheEntry(key)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "cache entry not found")
+		return
+	}
+
+	ttl, _ := lib.GetTTL(key)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"entry":       entry,
+		"ttl_seconds": int64(ttl.Seconds()),
+	})
+}
+
+// purgeRequest selects what to purge; exactly one field must be set
+type purgeRequest struct {
+	Key    string `json:"key"`
+	Prefix string `json:"prefix"`
+	Tag    string `json:"tag"`
+}
+
+// Purge removes a single key, a whole cache group or everything with a tag
+func (a *CacheAdmin) Purge(w http.ResponseWriter, r *http.Request) {
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	set := 0
+	for _, value := range []string{req.Key, req.Prefix, req.Tag} {
+		if value != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		writeError(w, http.StatusBadRequest, "set exactly one of key, prefix or tag")
+		return
+	}
+
+	var err error
+	switch {
+	case req.Key != "":
+		if !a.isCacheKey(req.Key) {
+			writeError(w, http.StatusBadRequest, "key is not in a cache group")
+			return
+		}
+		err = lib.DeleteCache(req.Key)
+	case req.Prefix != "":
+		if !contains(a.groups(), req.Prefix) {
+			writeError(w, http.StatusNotFound, "unknown cache group "+req.Prefix)
+			return
+		}
+		err = middleware.PurgeGroup(req.Prefix)
+	case req.Tag != "":
+		err = middleware.PurgeTag(req.Tag)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"purged": req})
+}
+
+// Warm re-warms the endpoints of the active policies, or of one group with
+// ?prefix, and returns the per-endpoint report
+func (a *CacheAdmin) Warm(w http.ResponseWriter, r *http.Request) {
+	if a.config.Warmer == nil {
+		writeError(w, http.StatusServiceUnavailable, "cache warming is not configured")
+		return
+	}
+
+	var report middleware.WarmReport
+	if prefix := r.URL.Query().Get("prefix"); prefix != "" {
+		if !contains(a.groups(), prefix) {
+			writeError(w, http.StatusNotFound, "unknown cache group "+prefix)
+			return
+		}
+		report = a.config.Warmer.WarmGroups(r.Context(), prefix)
+	} else {
+		report = a.config.Warmer.WarmAll(r.Context())
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// groupStats are the counters of a cache group with its hit ratio
+type groupStats struct {
+	middleware.CacheCounters
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// Stats shows hit ratios per cache group and the rate limit mode for this instance
+func (a *CacheAdmin) Stats(w http.ResponseWriter, r *http.Request) {
+	groups := make(map[string]groupStats)
+	var total middleware.CacheCounters
+	for group, counters := range middleware.CacheStats() {
+		groups[group] = groupStats{CacheCounters: counters, HitRatio: counters.HitRatio()}
+		total.Hits += counters.Hits
+		total.Stale += counters.Stale
+		total.Misses += counters.Misses
+		total.Bypass += counters.Bypass
+		total.Stores += counters.Stores
+		total.StoreErrors += counters.StoreErrors
+		total.NegativeHits += counters.NegativeHits
+		total.NegativeStores += counters.NegativeStores
+		total.EarlyRefreshes += counters.EarlyRefreshes
+	}
+
+	// Key namespace per group, to check what a deploy changed
+	versions := make(map[string]string)
+	for _, policy := range a.config.Policies.Policies() {
+		versions[policy.Prefix] = policy.SchemaVersion
+		if policy.SchemaVersion == "" {
+			versions[policy.Prefix] = lib.CacheVersion()
+		}
+	}
+
+	response := map[string]interface{}{
+		"groups":   groups,
+		"total":    groupStats{CacheCounters: total, HitRatio: total.HitRatio()},
+		"versions": versions,
+		// Whether rate limits are shared in Redis or per instance right now
+		"rate_limit": middleware.RateLimitStats(),
+	}
+	if stats, err := lib.GetStats(); err == nil {
+		response["redis_db_size"] = stats["db_size"]
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// groups returns the prefixes of the active cache policies
+func (a *CacheAdmin) groups() []string {
+	var groups []string
+	for _, policy := range a.config.Policies.Policies() {
+		groups = append(groups, policy.Prefix)
+	}
+	return groups
+}
+
+// isCacheKey reports whether key belongs to one of the cache groups
+func (a *CacheAdmin) isCacheKey(key string) bool {
+	for _, group := range a.groups() {
+		if strings.HasPrefix(key, lib.CacheKey(group)+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowMethod rejects requests with any other method
+func allowMethod(method string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		handler(w, r)
+	})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error in the {"error": "..."} shape the frontend expects
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
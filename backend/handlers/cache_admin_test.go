@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/jeffreasy/dkl25/backend/lib"
+	"github.com/jeffreasy/dkl25/backend/middleware"
+)
+
+// newCacheAdminMux serves the cache admin API on a fresh in-memory Redis.
+// Requests with "X-Test-Permission: cache:manage" hold the permission.
+func newCacheAdminMux(t *testing.T) (*http.ServeMux, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	lib.RedisClient = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	mux := http.NewServeMux()
+	NewCacheAdmin(CacheAdminConfig{
+		Permissions: func(r *http.Request, resource, action string) bool {
+			return r.Header.Get("X-Test-Permission") == resource+":"+action
+		},
+	}).Routes(mux, "/api/admin/cache")
+	return mux, mr
+}
+
+// adminRequest sends a request holding cache:manage and decodes the JSON response
+func adminRequest(mux *http.ServeMux, method, target, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("X-Test-Permission", "cache:manage")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	var response map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	return rec.Code, response
+}
+
+func TestCacheAdminRequiresPermission(t *testing.T) {
+	mux, _ := newCacheAdminMux(t)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/admin/cache/stats", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("without permission: %d, want 403", rec.Code)
+	}
+}
+
+func TestCacheAdminListsViewsAndPurges(t *testing.T) {
+	mux, mr := newCacheAdminMux(t)
+	cached := middleware.SmartCacheMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id":1}]`))
+	}))
+	for _, path := range []string{"/api/photos", "/api/photos/42", "/api/albums"} {
+		cached.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	mr.Set(lib.CacheKey("ratelimit", "1.1.1.1"), "3")
+
+	status, response := adminRequest(mux, "GET", "/api/admin/cache/keys?prefix=photos", "")
+	if status != http.StatusOK || response["count"] != float64(2) {
+		t.Fatalf("keys: %d %v, want 2 photo entries", status, response)
+	}
+	key := response["entries"].([]interface{})[0].(map[string]interface{})["key"].(string)
+
+	status, response = adminRequest(mux, "GET", "/api/admin/cache/entry?key="+key, "")
+	if status != http.StatusOK || response["entry"].(map[string]interface{})["status"] != float64(200) {
+		t.Errorf("entry: %d %v", status, response)
+	}
+
+	// Only cache groups can be viewed or purged
+	for _, tc := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{"GET", "/api/admin/cache/entry?key=" + lib.CacheKey("ratelimit", "1.1.1.1"), "", http.StatusBadRequest},
+		{"POST", "/api/admin/cache/purge", `{"key": "` + lib.CacheKey("ratelimit", "1.1.1.1") + `"}`, http.StatusBadRequest},
+		{"POST", "/api/admin/cache/purge", `{"prefix": "ratelimit"}`, http.StatusNotFound},
+		{"POST", "/api/admin/cache/purge", `{"prefix": "photos", "tag": "photos"}`, http.StatusBadRequest},
+		{"GET", "/api/admin/cache/purge", "", http.StatusMethodNotAllowed},
+	} {
+		if status, _ := adminRequest(mux, tc.method, tc.target, tc.body); status != tc.want {
+			t.Errorf("%s %s %s: %d, want %d", tc.method, tc.target, tc.body, status, tc.want)
+		}
+	}
+
+	if status, _ := adminRequest(mux, "POST", "/api/admin/cache/purge", `{"prefix": "photos"}`); status != http.StatusOK {
+		t.Fatalf("purge: %d", status)
+	}
+	if _, response := adminRequest(mux, "GET", "/api/admin/cache/keys", ""); response["count"] != float64(1) {
+		t.Errorf("after purge: %v, want only the albums entry", response)
+	}
+	if !mr.Exists(lib.CacheKey("ratelimit", "1.1.1.1")) {
+		t.Error("purge touched a rate limit counter")
+	}
+}
@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of calling Redis while a circuit is open
+var ErrCircuitOpen = errors.New("redis circuit open")
+
+// Circuit stops calling Redis after Threshold failures in a row, so callers
+// fall back at once instead of waiting for timeouts on every request. After
+// Cooldown a single call is let through to probe whether Redis is back.
+type Circuit struct {
+	Name      string
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// RateLimitCircuit guards the rate limit scripts
+var RateLimitCircuit = &Circuit{Name: "rate limit", Threshold: 3, Cooldown: 10 * time.Second}
+
+// Open reports whether calls are currently refused
+func (c *Circuit) Open() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failures >= c.Threshold && (c.probing || time.Since(c.openedAt) < c.Cooldown)
+}
+
+// Do runs fn unless the circuit is open, and records its outcome
+func (c *Circuit) Do(fn func() error) error {
+	c.mu.Lock()
+	if c.failures >= c.Threshold {
+		if c.probing || time.Since(c.openedAt) < c.Cooldown {
+			c.mu.Unlock()
+			return ErrCircuitOpen
+		}
+		c.probing = true
+	}
+	c.mu.Unlock()
+
+	err := fn()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probing = false
+	if err == nil {
+		if c.failures >= c.Threshold {
+			log.Printf("Redis %s circuit closed, Redis is back", c.Name)
+		}
+		c.failures = 0
+		return nil
+	}
+
+	c.failures++
+	if c.failures >= c.Threshold {
+		if c.failures == c.Threshold {
+			log.Printf("Redis %s circuit open after %d failures: %v", c.Name, c.failures, err)
+		}
+		// A failed probe starts a new cooldown
+		c.openedAt = time.Now()
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitOpensProbesAndCloses(t *testing.T) {
+	c := &Circuit{Name: "test", Threshold: 2, Cooldown: 50 * time.Millisecond}
+	down := errors.New("connection refused")
+	calls := 0
+	call := func(err error) error {
+		return c.Do(func() error {
+			calls++
+			return err
+		})
+	}
+
+	// Closed: failures below the threshold still reach Redis
+	call(down)
+	if c.Open() {
+		t.Fatal("open after one failure")
+	}
+	call(down)
+	if !c.Open() {
+		t.Fatal("closed after two failures")
+	}
+
+	// Open: calls fail fast without reaching Redis
+	if err := call(nil); !errors.Is(err, ErrCircuitOpen) || calls != 2 {
+		t.Fatalf("open circuit: err %v after %d calls", err, calls)
+	}
+
+	// Half-open after the cooldown: one probe, and a failed one starts a
+	// new cooldown
+	time.Sleep(60 * time.Millisecond)
+	if c.Open() {
+		t.Fatal("still open after the cooldown")
+	}
+	if err := call(down); err != down || calls != 3 {
+		t.Fatalf("probe: err %v after %d calls", err, calls)
+	}
+	if err := call(nil); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("after a failed probe: err %v, want the circuit open", err)
+	}
+
+	// Only one probe runs at a time
+	time.Sleep(60 * time.Millisecond)
+	err := c.Do(func() error {
+		calls++
+		if err := call(nil); !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("call during a probe: err %v", err)
+		}
+		return nil
+	})
+	if err != nil || c.Open() {
+		t.Fatalf("successful probe: err %v, open %v", err, c.Open())
+	}
+
+	// Closed again: calls reach Redis and the failure count starts over
+	if call(down); c.Open() || calls != 5 {
+		t.Errorf("closed circuit: open %v after %d calls", c.Open(), calls)
+	}
+}
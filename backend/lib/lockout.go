@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Lockout locks a key (an account, an IP) out after repeated failures, with
+// a lock that doubles with every further failure
+type Lockout struct {
+	Threshold int           // failures before the first lock
+	Window    time.Duration // failures are forgotten this long after the last lock ends
+	Base      time.Duration // first lock
+	Max       time.Duration // longest lock
+}
+
+// LockoutStatus is the state of a locked out key
+type LockoutStatus struct {
+	Failures  int64
+	LockedFor time.Duration // 0 when not locked
+}
+
+// lockoutFailureScript counts a failure and, from threshold failures on,
+// locks the key for base * 2^(failures - threshold), at most max. Failures
+// are kept for the lock plus window, so a retry after the lock doubles it.
+// KEYS[1] failures, KEYS[2] lock; ARGV threshold, window ms, base ms, max ms.
+// Returns {failures, lock ms}.
+var lockoutFailureScript = redis.NewScript(`
+local failures = redis.call('INCR', KEYS[1])
+local threshold, window, base, max = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4])
+local lock = 0
+if failures >= threshold then
+	lock = math.floor(math.min(base * 2 ^ (failures - threshold), max))
+	redis.call('SET', KEYS[2], failures, 'PX', string.format('%d', lock))
+end
+redis.call('PEXPIRE', KEYS[1], string.format('%d', window + lock))
+return {failures, lock}
+`)
+
+// lockKey is where the lock of a lockout key is stored
+func lockKey(key string) string {
+	return key + ":lock"
+}
+
+// Fail records a failure of key and returns the lock it started, if any
+func (l Lockout) Fail(key string) (LockoutStatus, error) {
+	values, err := runLimitScript(lockoutFailureScript, []string{key, lockKey(key)},
+		l.Threshold, l.Window.Milliseconds(), l.Base.Milliseconds(), l.Max.Milliseconds())
+	if err != nil {
+		return LockoutStatus{}, fmt.Errorf("lockout %s: %w", key, err)
+	}
+	return LockoutStatus{Failures: values[0], LockedFor: time.Duration(values[1]) * time.Millisecond}, nil
+}
+
+// LockedFor returns how long the longest lock of the keys still lasts
+func LockedFor(keys ...string) (time.Duration, error) {
+	var locked time.Duration
+	err := RateLimitCircuit.Do(func() error {
+		pipe := RedisClient.Pipeline()
+		ttls := make([]*redis.DurationCmd, len(keys))
+		for i, key := range keys {
+			ttls[i] = pipe.PTTL(ctx, lockKey(key))
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+		for _, ttl := range ttls {
+			locked = max(locked, ttl.Val())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("lockout check: %w", err)
+	}
+	return locked, nil
+}
+
+// GetLockout returns the failures and lock of a key
+func GetLockout(key string) (LockoutStatus, error) {
+	pipe := RedisClient.Pipeline()
+	failures := pipe.Get(ctx, key)
+	ttl := pipe.PTTL(ctx, lockKey(key))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return LockoutStatus{}, fmt.Errorf("lockout %s: %w", key, err)
+	}
+
+	status := LockoutStatus{LockedFor: max(0, ttl.Val())}
+	status.Failures, _ = failures.Int64()
+	return status, nil
+}
+
+// ClearLockout forgets the failures and lifts the locks of the keys
+func ClearLockout(keys ...string) error {
+	all := make([]string, 0, 2*len(keys))
+	for _, key := range keys {
+		all = append(all, key, lockKey(key))
+	}
+	return RedisClient.Del(ctx, all...).Err()
+}
@@ -0,0 +1,369 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// clock is the time the limiters pass to their scripts; tests replace it
+var clock = time.Now
+
+// RateLimitResult is the outcome of an atomic rate limit check
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // until a denied request would be allowed; 0 when allowed
+	ResetAfter time.Duration // until the full limit is available again
+}
+
+// runLimitScript runs a rate limit script through RateLimitCircuit
+func runLimitScript(script *redis.Script, keys []string, args ...interface{}) ([]int64, error) {
+	var values []int64
+	err := RateLimitCircuit.Do(func() error {
+		var err error
+		values, err = script.Run(ctx, RedisClient, keys, args...).Int64Slice()
+		return err
+	})
+	return values, err
+}
+
+// slidingLogScript keeps one sorted set entry per allowed request, scored by
+// its time in milliseconds. Denied requests are not logged, so retrying does
+// not extend a block.
+// KEYS[1] log; ARGV limit, window ms, now ms, unique member.
+// Returns {allowed, count, score of the entry that blocks the next request, newest score}.
+var slidingLogScript = redis.NewScript(`
+local limit, window, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], window)
+	count = count + 1
+	allowed = 1
+end
+local blocking = 0
+if count >= limit and limit > 0 then
+	blocking = tonumber(redis.call('ZRANGE', KEYS[1], count - limit, count - limit, 'WITHSCORES')[2])
+end
+local newest = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')[2]
+return {allowed, count, blocking, tonumber(newest or now)}
+`)
+
+// SlidingLog allows limit requests in any window-long period. It is exact but
+// stores an entry per request; SlidingWindowCounter is the cheap estimate.
+func SlidingLog(key string, limit int, window time.Duration) (RateLimitResult, error) {
+	now := clock().UnixMilli()
+	member := strconv.FormatInt(now, 10) + "-" + strconv.FormatInt(rand.Int63(), 36)
+
+	values, err := runLimitScript(slidingLogScript, []string{key}, limit, window.Milliseconds(), now, member)
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("sliding log %s: %w", key, err)
+	}
+	allowed, count, blocking, newest := values[0] == 1, values[1], values[2], values[3]
+
+	result := RateLimitResult{
+		Allowed:    allowed,
+		Limit:      limit,
+		Remaining:  max(0, limit-int(count)),
+		ResetAfter: time.Duration(newest+window.Milliseconds()-now) * time.Millisecond,
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration(blocking+window.Milliseconds()-now) * time.Millisecond
+	}
+	return result, nil
+}
+
+// Limit is one limit of a stack checked by SlidingWindowCounters
+type Limit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// slidingCounterScript counts requests per fixed window and admits a request
+// while, for every limit, the previous window weighted by how much of it
+// still overlaps the sliding window plus the current window stays under the
+// limit. Only then are all current windows counted.
+// KEYS current and previous window per limit; ARGV limit, window ms and ms
+// elapsed in the current window per limit.
+// Returns {allowed, then current and previous count per limit}.
+var slidingCounterScript = redis.NewScript(`
+local allowed, counts = 1, {}
+for i = 1, #KEYS / 2 do
+	local limit, window, elapsed = tonumber(ARGV[3*i-2]), tonumber(ARGV[3*i-1]), tonumber(ARGV[3*i])
+	local current = tonumber(redis.call('GET', KEYS[2*i-1]) or '0')
+	local previous = tonumber(redis.call('GET', KEYS[2*i]) or '0')
+	if previous * (window - elapsed) / window + current >= limit then
+		allowed = 0
+	end
+	counts[2*i-1], counts[2*i] = current, previous
+end
+if allowed == 1 then
+	for i = 1, #KEYS / 2 do
+		counts[2*i-1] = redis.call('INCR', KEYS[2*i-1])
+		redis.call('PEXPIRE', KEYS[2*i-1], tonumber(ARGV[3*i-1]) * 2)
+	end
+end
+table.insert(counts, 1, allowed)
+return counts
+`)
+
+// SlidingWindowCounter approximates a sliding window with two counters per
+// key, assuming the previous window's requests were evenly spread
+func SlidingWindowCounter(key string, limit int, window time.Duration) (RateLimitResult, error) {
+	_, results, err := SlidingWindowCounters([]string{key}, []Limit{{Requests: limit, Window: window}})
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return results[0], nil
+}
+
+// SlidingWindowCounters checks several limits at once, e.g. per minute and
+// per day, with a key each. A request is counted against all of them or, when
+// any limit is reached, against none. The result of a limit tells whether it
+// had room itself.
+func SlidingWindowCounters(keys []string, limits []Limit) (bool, []RateLimitResult, error) {
+	now := clock().UnixMilli()
+	windowKeys := make([]string, 0, 2*len(keys))
+	args := make([]interface{}, 0, 3*len(keys))
+	for i, key := range keys {
+		size := limits[i].Window.Milliseconds()
+		index, elapsed := now/size, now%size
+		windowKeys = append(windowKeys, key+":"+strconv.FormatInt(index, 10), key+":"+strconv.FormatInt(index-1, 10))
+		args = append(args, limits[i].Requests, size, elapsed)
+	}
+
+	values, err := runLimitScript(slidingCounterScript, windowKeys, args...)
+	if err != nil {
+		return false, nil, fmt.Errorf("sliding window counter %s: %w", strings.Join(keys, ", "), err)
+	}
+
+	allowed := values[0] == 1
+	results := make([]RateLimitResult, len(keys))
+	for i := range keys {
+		size := limits[i].Window.Milliseconds()
+		results[i] = slidingCounterResult(limits[i].Requests, size, now%size, allowed, float64(values[2*i+1]), float64(values[2*i+2]))
+	}
+	return allowed, results, nil
+}
+
+// slidingCounterResult works out the result of one limit from its counts,
+// which include the request when it was counted
+func slidingCounterResult(limit int, size, elapsed int64, counted bool, current, previous float64) RateLimitResult {
+	// Time in ms until the weighted count drops below the limit
+	untilBelow := func(previous, current, elapsed float64) float64 {
+		if current >= float64(limit) || previous == 0 {
+			return math.Inf(1)
+		}
+		// previous * (size - t) / size + current < limit
+		t := float64(size)*(1-(float64(limit)-current)/previous) + 1
+		return math.Max(0, math.Floor(t)-elapsed)
+	}
+
+	estimate := previous*float64(size-elapsed)/float64(size) + current
+	result := RateLimitResult{
+		Allowed:   counted || estimate < float64(limit),
+		Limit:     limit,
+		Remaining: max(0, limit-int(math.Ceil(estimate))),
+	}
+	switch {
+	case current > 0:
+		result.ResetAfter = time.Duration(2*size-elapsed) * time.Millisecond
+	case previous > 0:
+		result.ResetAfter = time.Duration(size-elapsed) * time.Millisecond
+	}
+	if !result.Allowed {
+		wait := untilBelow(previous, current, float64(elapsed))
+		if wait >= float64(size-elapsed) {
+			// Not in this window; in the next one the current count is the previous
+			wait = float64(size-elapsed) + untilBelow(current, 0, 0)
+		}
+		if math.IsInf(wait, 1) {
+			// Only with a zero limit
+			wait = float64(size)
+		}
+		result.RetryAfter = time.Duration(wait) * time.Millisecond
+	}
+	return result
+}
+
+// tokenBucketScript refills a bucket for the exact time passed since its last
+// update and takes one token. Tokens are fractional; they are returned in
+// thousandths since Lua numbers come back as integers.
+// KEYS[1] bucket; ARGV capacity, tokens per ms, now ms.
+// Returns {allowed, milli-tokens left}.
+var tokenBucketScript = redis.NewScript(`
+local capacity, rate, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) * rate)
+	ts = now
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', ts)
+-- A full bucket is the same as no bucket, so it can expire then
+redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - tokens) / rate) + 1)
+return {allowed, math.floor(tokens * 1000)}
+`)
+
+// TokenBucket allows bursts of up to capacity requests, refilled continuously
+// at refillRate tokens per refillInterval. For a denied request RetryAfter is
+// the exact time until the next whole token.
+func TokenBucket(key string, capacity, refillRate int, refillInterval time.Duration) (RateLimitResult, error) {
+	if capacity <= 0 || refillRate <= 0 || refillInterval < time.Millisecond {
+		return RateLimitResult{}, fmt.Errorf("token bucket %s: capacity %d, refill rate %d and refill interval %s must be positive", key, capacity, refillRate, refillInterval)
+	}
+	rate := float64(refillRate) / float64(refillInterval.Milliseconds()) // tokens per ms
+
+	values, err := runLimitScript(tokenBucketScript, []string{key}, capacity, rate, clock().UnixMilli())
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("token bucket %s: %w", key, err)
+	}
+	allowed, tokens := values[0] == 1, float64(values[1])/1000
+
+	result := RateLimitResult{
+		Allowed:    allowed,
+		Limit:      capacity,
+		Remaining:  int(tokens),
+		ResetAfter: time.Duration(math.Ceil((float64(capacity)-tokens)/rate)) * time.Millisecond,
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration(math.Ceil((1-tokens)/rate)) * time.Millisecond
+	}
+	return result, nil
+}
+
+// gcraScript stores the theoretical arrival time (TAT) of the next request in
+// microseconds. A request is allowed unless the TAT is more than the burst
+// tolerance ahead of now; each allowed request pushes the TAT one emission
+// interval further.
+// KEYS[1] TAT; ARGV emission interval, tolerance, now (all µs).
+// Returns {allowed, µs the TAT is ahead of now}.
+var gcraScript = redis.NewScript(`
+local interval, tolerance, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local tat = math.max(tonumber(redis.call('GET', KEYS[1]) or '0'), now)
+if tat - now > tolerance then
+	return {0, tat - now}
+end
+tat = tat + interval
+redis.call('SET', KEYS[1], string.format('%d', tat), 'PX', math.ceil((tat - now) / 1000))
+return {1, tat - now}
+`)
+
+// GCRA allows limit requests per window, paced evenly: a burst of limit is
+// allowed from idle, after that one request per window/limit. It keeps a
+// single key per client.
+func GCRA(key string, limit int, window time.Duration) (RateLimitResult, error) {
+	if limit <= 0 || window < time.Duration(limit)*time.Microsecond {
+		return RateLimitResult{}, fmt.Errorf("gcra %s: %d requests per %s; need a positive limit and at least 1µs per request", key, limit, window)
+	}
+	interval := window / time.Duration(limit)
+	tolerance := window - interval
+
+	values, err := runLimitScript(gcraScript, []string{key}, interval.Microseconds(), tolerance.Microseconds(), clock().UnixMicro())
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("gcra %s: %w", key, err)
+	}
+	allowed, ahead := values[0] == 1, time.Duration(values[1])*time.Microsecond
+
+	result := RateLimitResult{Allowed: allowed, Limit: limit, ResetAfter: ahead}
+	if allowed {
+		result.Remaining = int((window - ahead) / interval)
+	} else {
+		result.RetryAfter = ahead - tolerance
+	}
+	return result, nil
+}
+
+// budgetScript adds cost to the budget used unless that would exceed the
+// budget. The window starts at first use and is never extended; a denial
+// before that reports a whole window.
+// KEYS[1] budget used; ARGV cost, budget, window ms.
+// Returns {allowed, used, ms until the window ends}.
+var budgetScript = redis.NewScript(`
+local cost, budget, window = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local used = tonumber(redis.call('GET', KEYS[1]) or '0')
+if used + cost > budget then
+	local ttl = redis.call('PTTL', KEYS[1])
+	if ttl < 0 then
+		ttl = window
+	end
+	return {0, used, ttl}
+end
+used = redis.call('INCRBY', KEYS[1], cost)
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+	redis.call('PEXPIRE', KEYS[1], window)
+	ttl = window
+end
+return {1, used, ttl}
+`)
+
+// ConsumeBudget spends cost from a budget per window. Remaining is the budget
+// left; a denied request spends nothing.
+func ConsumeBudget(key string, cost, budget int, window time.Duration) (RateLimitResult, error) {
+	values, err := runLimitScript(budgetScript, []string{key}, cost, budget, window.Milliseconds())
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("budget %s: %w", key, err)
+	}
+	allowed, used, ttl := values[0] == 1, int(values[1]), time.Duration(max(0, values[2]))*time.Millisecond
+
+	result := RateLimitResult{
+		Allowed:    allowed,
+		Limit:      budget,
+		Remaining:  max(0, budget-used),
+		ResetAfter: ttl,
+	}
+	if !allowed {
+		result.RetryAfter = ttl
+	}
+	return result, nil
+}
+
+// fixedWindowScript counts a request and starts the window on the first one.
+// A key left without expiry, e.g. by an older non-atomic limiter, gets one too.
+// KEYS[1] counter; ARGV window ms. Returns {count, ms until the window ends}.
+var fixedWindowScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+	ttl = tonumber(ARGV[1])
+end
+return {count, ttl}
+`)
+
+// FixedWindow allows limit requests per window starting at a client's first
+// request. Denied requests count too, so hammering does not help.
+func FixedWindow(key string, limit int, window time.Duration) (RateLimitResult, error) {
+	values, err := runLimitScript(fixedWindowScript, []string{key}, window.Milliseconds())
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("fixed window %s: %w", key, err)
+	}
+	count, ttl := values[0], time.Duration(values[1])*time.Millisecond
+
+	result := RateLimitResult{
+		Allowed:    count <= int64(limit),
+		Limit:      limit,
+		Remaining:  max(0, limit-int(count)),
+		ResetAfter: ttl,
+	}
+	if !result.Allowed {
+		result.RetryAfter = ttl
+	}
+	return result, nil
+}
@@ -0,0 +1,203 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+// setClock fixes the limiters' clock at a window boundary and returns a
+// function that moves it forward
+func setClock(t *testing.T) (advance func(time.Duration)) {
+	t.Helper()
+	now := time.UnixMilli(1_800_000_000_000)
+	clock = func() time.Time { return now }
+	t.Cleanup(func() { clock = time.Now })
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+// check runs a limiter and compares the parts of its result that are set in want
+func check(t *testing.T, step string, got RateLimitResult, err error, want RateLimitResult) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", step, err)
+	}
+	if got.Allowed != want.Allowed || got.Remaining != want.Remaining || got.RetryAfter != want.RetryAfter || got.ResetAfter != want.ResetAfter {
+		t.Errorf("%s: got %+v, want %+v", step, got, want)
+	}
+}
+
+func TestSlidingLog(t *testing.T) {
+	setupRedis(t)
+	advance := setClock(t)
+
+	for i := 0; i < 3; i++ {
+		result, err := SlidingLog("log", 3, time.Second)
+		check(t, "request", result, err, RateLimitResult{Allowed: true, Remaining: 2 - i, ResetAfter: time.Second})
+		advance(100 * time.Millisecond)
+	}
+
+	// At 300ms the first request blocks until it leaves the window at 1s
+	result, err := SlidingLog("log", 3, time.Second)
+	check(t, "at the limit", result, err, RateLimitResult{RetryAfter: 700 * time.Millisecond, ResetAfter: 900 * time.Millisecond})
+
+	// Denied requests are not logged, so they do not extend the block
+	advance(699 * time.Millisecond)
+	result, err = SlidingLog("log", 3, time.Second)
+	check(t, "just before", result, err, RateLimitResult{RetryAfter: time.Millisecond, ResetAfter: 201 * time.Millisecond})
+	advance(time.Millisecond)
+	result, err = SlidingLog("log", 3, time.Second)
+	check(t, "first request left the window", result, err, RateLimitResult{Allowed: true, ResetAfter: time.Second})
+
+	// After a full window everything has rolled out
+	advance(time.Second)
+	result, err = SlidingLog("log", 3, time.Second)
+	check(t, "after a window", result, err, RateLimitResult{Allowed: true, Remaining: 2, ResetAfter: time.Second})
+}
+
+func TestSlidingWindowCounter(t *testing.T) {
+	setupRedis(t)
+	advance := setClock(t)
+
+	advance(500 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		result, err := SlidingWindowCounter("counter", 4, time.Second)
+		check(t, "request", result, err, RateLimitResult{Allowed: true, Remaining: 3 - i, ResetAfter: 1500 * time.Millisecond})
+	}
+
+	// Full in this window: room comes just after the next window starts,
+	// when the 4 requests weigh less than 4
+	result, err := SlidingWindowCounter("counter", 4, time.Second)
+	check(t, "at the limit", result, err, RateLimitResult{RetryAfter: 501 * time.Millisecond, ResetAfter: 1500 * time.Millisecond})
+
+	// 250ms into the next window the previous 4 weigh 3
+	advance(750 * time.Millisecond)
+	result, err = SlidingWindowCounter("counter", 4, time.Second)
+	check(t, "next window", result, err, RateLimitResult{Allowed: true, ResetAfter: 1750 * time.Millisecond})
+	result, err = SlidingWindowCounter("counter", 4, time.Second)
+	check(t, "weighted limit", result, err, RateLimitResult{RetryAfter: time.Millisecond, ResetAfter: 1750 * time.Millisecond})
+	advance(time.Millisecond)
+	result, err = SlidingWindowCounter("counter", 4, time.Second)
+	check(t, "weight dropped", result, err, RateLimitResult{Allowed: true, ResetAfter: 1749 * time.Millisecond})
+
+	// Two windows later both counters are gone
+	advance(2 * time.Second)
+	result, err = SlidingWindowCounter("counter", 4, time.Second)
+	check(t, "after two windows", result, err, RateLimitResult{Allowed: true, Remaining: 3, ResetAfter: 1749 * time.Millisecond})
+}
+
+func TestSlidingWindowCountersAreAllOrNothing(t *testing.T) {
+	setupRedis(t)
+	setClock(t)
+	limits := []Limit{{Requests: 5, Window: time.Second}, {Requests: 2, Window: time.Hour}}
+
+	for i, want := range []bool{true, true, false, false} {
+		allowed, results, err := SlidingWindowCounters([]string{"second", "hour"}, limits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != want {
+			t.Fatalf("request %d: allowed %v, want %v", i, allowed, want)
+		}
+		if !allowed && (!results[0].Allowed || results[1].Allowed) {
+			t.Errorf("request %d: per-limit results %+v, want only the hourly limit full", i, results)
+		}
+	}
+	// Denied requests counted against neither limit
+	if _, results, _ := SlidingWindowCounters([]string{"second", "hour"}, limits); results[0].Remaining != 3 {
+		t.Errorf("per-second limit has %d left, want 3", results[0].Remaining)
+	}
+}
+
+func TestTokenBucketRefillsFractionally(t *testing.T) {
+	setupRedis(t)
+	advance := setClock(t)
+
+	// 3 tokens, refilled at 1 per second
+	for i := 0; i < 3; i++ {
+		result, err := TokenBucket("bucket", 3, 1, time.Second)
+		check(t, "burst", result, err, RateLimitResult{Allowed: true, Remaining: 2 - i, ResetAfter: time.Duration(i+1) * time.Second})
+	}
+	result, err := TokenBucket("bucket", 3, 1, time.Second)
+	check(t, "empty", result, err, RateLimitResult{RetryAfter: time.Second, ResetAfter: 3 * time.Second})
+
+	// Half a token is not enough, but counts towards the next one
+	advance(500 * time.Millisecond)
+	result, err = TokenBucket("bucket", 3, 1, time.Second)
+	check(t, "half a token", result, err, RateLimitResult{RetryAfter: 500 * time.Millisecond, ResetAfter: 2500 * time.Millisecond})
+	advance(500 * time.Millisecond)
+	result, err = TokenBucket("bucket", 3, 1, time.Second)
+	check(t, "one token", result, err, RateLimitResult{Allowed: true, ResetAfter: 3 * time.Second})
+
+	// 2.5s refill 2.5 tokens; the half stays in the bucket
+	advance(2500 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		result, err = TokenBucket("bucket", 3, 1, time.Second)
+		check(t, "refilled", result, err, RateLimitResult{Allowed: true, Remaining: 1 - i, ResetAfter: time.Duration(1500+1000*i) * time.Millisecond})
+	}
+	result, err = TokenBucket("bucket", 3, 1, time.Second)
+	check(t, "half left", result, err, RateLimitResult{RetryAfter: 500 * time.Millisecond, ResetAfter: 2500 * time.Millisecond})
+
+	// The bucket never holds more than its capacity
+	advance(time.Hour)
+	result, err = TokenBucket("bucket", 3, 1, time.Second)
+	check(t, "after an hour", result, err, RateLimitResult{Allowed: true, Remaining: 2, ResetAfter: time.Second})
+}
+
+func TestGCRAAdvancesTAT(t *testing.T) {
+	setupRedis(t)
+	advance := setClock(t)
+
+	// 4 per second: one every 250ms, with a burst of 4 from idle
+	for i := 0; i < 4; i++ {
+		result, err := GCRA("gcra", 4, time.Second)
+		check(t, "burst", result, err, RateLimitResult{Allowed: true, Remaining: 3 - i, ResetAfter: time.Duration(i+1) * 250 * time.Millisecond})
+	}
+	result, err := GCRA("gcra", 4, time.Second)
+	check(t, "burst used", result, err, RateLimitResult{RetryAfter: 250 * time.Millisecond, ResetAfter: time.Second})
+
+	// A denied request does not move the TAT; an emission interval later
+	// exactly one request fits
+	advance(250 * time.Millisecond)
+	result, err = GCRA("gcra", 4, time.Second)
+	check(t, "paced", result, err, RateLimitResult{Allowed: true, ResetAfter: time.Second})
+	result, err = GCRA("gcra", 4, time.Second)
+	check(t, "paced again", result, err, RateLimitResult{RetryAfter: 250 * time.Millisecond, ResetAfter: time.Second})
+
+	// Idle for longer than the window restores the full burst
+	advance(2 * time.Second)
+	result, err = GCRA("gcra", 4, time.Second)
+	check(t, "after idle", result, err, RateLimitResult{Allowed: true, Remaining: 3, ResetAfter: 250 * time.Millisecond})
+}
+
+func TestConsumeBudget(t *testing.T) {
+	mr := setupRedis(t)
+
+	result, err := ConsumeBudget("budget", 4, 10, time.Minute)
+	check(t, "first", result, err, RateLimitResult{Allowed: true, Remaining: 6, ResetAfter: time.Minute})
+	result, err = ConsumeBudget("budget", 4, 10, time.Minute)
+	check(t, "second", result, err, RateLimitResult{Allowed: true, Remaining: 2, ResetAfter: time.Minute})
+
+	// The window is not extended by later spending; a denial spends nothing
+	mr.FastForward(20 * time.Second)
+	result, err = ConsumeBudget("budget", 4, 10, time.Minute)
+	check(t, "exhausted", result, err, RateLimitResult{Remaining: 2, RetryAfter: 40 * time.Second, ResetAfter: 40 * time.Second})
+	result, err = ConsumeBudget("budget", 2, 10, time.Minute)
+	check(t, "rest", result, err, RateLimitResult{Allowed: true, ResetAfter: 40 * time.Second})
+
+	// A new window after the old one ends
+	mr.FastForward(40 * time.Second)
+	result, err = ConsumeBudget("budget", 4, 10, time.Minute)
+	check(t, "next window", result, err, RateLimitResult{Allowed: true, Remaining: 6, ResetAfter: time.Minute})
+}
+
+func TestConsumeBudgetDeniedBeforeFirstUse(t *testing.T) {
+	mr := setupRedis(t)
+
+	// A cost above the budget is denied before the window starts; the
+	// client is told to wait a whole window, not 0
+	result, err := ConsumeBudget("budget", 11, 10, time.Minute)
+	check(t, "too expensive", result, err, RateLimitResult{Remaining: 10, RetryAfter: time.Minute, ResetAfter: time.Minute})
+	if mr.Exists("budget") {
+		t.Error("a denied request started a window")
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -15,8 +18,15 @@ var (
 	// RedisClient is the global Redis client instance
 	RedisClient *redis.Client
 	ctx         = context.Background()
+
+	// cacheVersion namespaces response cache keys, see SetCacheVersion
+	cacheVersion atomic.Value
 )
 
+func init() {
+	SetCacheVersion(os.Getenv("APP_VERSION"))
+}
+
 // RedisConfig holds Redis configuration
 type RedisConfig struct {
 	Host     string
@@ -78,6 +88,46 @@ func CacheKey(prefix string, parts ...string) string {
 	return key
 }
 
+// SetCacheVersion sets the build version (as served on /api/version) that
+// response cache keys are namespaced with, so a deploy never serves JSON
+// cached by an older build. It defaults to $APP_VERSION.
+func SetCacheVersion(version string) {
+	cacheVersion.Store(strings.NewReplacer(":", "_", "*", "_").Replace(version))
+}
+
+// CacheVersion returns the build version set with SetCacheVersion
+func CacheVersion() string {
+	return cacheVersion.Load().(string)
+}
+
+// VersionedCacheKey generates a cache key in the namespace of a version,
+// e.g. dkl:photos:v2.1.0:/api/photos. An empty version gives CacheKey.
+func VersionedCacheKey(prefix, version string, parts ...string) string {
+	if version == "" {
+		return CacheKey(prefix, parts...)
+	}
+	return CacheKey(prefix, append([]string{"v" + version}, parts...)...)
+}
+
+// PurgeOtherVersions deletes the keys of a prefix that are not in the
+// namespace of version and returns how many were deleted
+func PurgeOtherVersions(prefix, version string) (int, error) {
+	keep := VersionedCacheKey(prefix, version) + ":"
+	purged := 0
+
+	iter := RedisClient.Scan(ctx, 0, CacheKey(prefix, "*"), 100).Iterator()
+	for iter.Next(ctx) {
+		if strings.HasPrefix(iter.Val(), keep) {
+			continue
+		}
+		if err := RedisClient.Unlink(ctx, iter.Val()).Err(); err != nil {
+			return purged, fmt.Errorf("failed to delete key %s: %w", iter.Val(), err)
+		}
+		purged++
+	}
+	return purged, iter.Err()
+}
+
 // SetCache stores data in Redis with TTL
 func SetCache(key string, data interface{}, ttl time.Duration) error {
 	jsonData, err := json.Marshal(data)
@@ -101,6 +151,23 @@ func GetCache(key string, dest interface{}) error {
 	return json.Unmarshal([]byte(data), dest)
 }
 
+// SetBytes stores raw bytes in Redis with TTL, without JSON encoding
+func SetBytes(key string, data []byte, ttl time.Duration) error {
+	return RedisClient.Set(ctx, key, data, ttl).Err()
+}
+
+// GetBytes retrieves bytes stored with SetBytes
+func GetBytes(key string) ([]byte, error) {
+	data, err := RedisClient.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("cache miss")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis get error: %w", err)
+	}
+	return data, nil
+}
+
 // DeleteCache removes a cache entry
 func DeleteCache(key string) error {
 	return RedisClient.Del(ctx, key).Err()
@@ -117,6 +184,139 @@ func InvalidatePattern(pattern string) error {
 	return iter.Err()
 }
 
+// TagKey generates the key of the set holding all cache keys with a tag
+func TagKey(tag string) string {
+	return CacheKey("tag", tag)
+}
+
+// TagKeys records a cache key under each tag so it can be invalidated by tag.
+// Tag sets are sorted sets scored by when each key expires; every write
+// trims the members that expired, so a set only names live keys. A tag set
+// lives as long as its longest-lived key; shorter TTLs never cut it.
+func TagKeys(tags []string, key string, ttl time.Duration) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	err := tagKeys(tags, key, ttl)
+	if err != nil && isWrongType(err) {
+		// A tag set from before they were scored; purge it like a write
+		// would and start a new one
+		for _, tag := range tags {
+			if err := InvalidateTag(tag); err != nil {
+				return err
+			}
+		}
+		err = tagKeys(tags, key, ttl)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to tag key %s: %w", key, err)
+	}
+	return nil
+}
+
+func tagKeys(tags []string, key string, ttl time.Duration) error {
+	now := time.Now()
+	expired := strconv.FormatInt(now.UnixMilli(), 10)
+
+	pipe := RedisClient.TxPipeline()
+	for _, tag := range tags {
+		pipe.ZAdd(ctx, TagKey(tag), redis.Z{Score: float64(now.Add(ttl).UnixMilli()), Member: key})
+		pipe.ZRemRangeByScore(ctx, TagKey(tag), "-inf", expired)
+		pipe.ExpireNX(ctx, TagKey(tag), ttl)
+		pipe.ExpireGT(ctx, TagKey(tag), ttl)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// InvalidateTag deletes all keys recorded under a tag, and the tag set itself
+func InvalidateTag(tag string) error {
+	tagKey := TagKey(tag)
+	keys, err := RedisClient.ZRange(ctx, tagKey, 0, -1).Result()
+	if err != nil && isWrongType(err) {
+		keys, err = RedisClient.SMembers(ctx, tagKey).Result()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read tag %s: %w", tag, err)
+	}
+
+	keys = append(keys, tagKey)
+	return RedisClient.Del(ctx, keys...).Err()
+}
+
+// InvalidateGroup deletes all keys of a cache group (prefix) together with
+// the tag sets named after it, e.g. "photos" and "photos:42"
+func InvalidateGroup(group string) error {
+	if err := InvalidatePattern(CacheKey(group, "*")); err != nil {
+		return err
+	}
+	if err := InvalidatePattern(TagKey(group + ":*")); err != nil {
+		return err
+	}
+	return DeleteCache(TagKey(group))
+}
+
+// isWrongType reports whether Redis refused a command for the key's type
+func isWrongType(err error) bool {
+	return strings.HasPrefix(err.Error(), "WRONGTYPE")
+}
+
+// KeyInfo describes a key for admin listings
+type KeyInfo struct {
+	Key        string `json:"key"`
+	TTLSeconds int64  `json:"ttl_seconds"` // -1 without expiry
+	SizeBytes  int64  `json:"size_bytes"`
+}
+
+// ListKeys returns up to limit keys matching the pattern with their TTL and
+// memory usage. It uses SCAN, so it is safe to run against production.
+func ListKeys(pattern string, limit int) ([]KeyInfo, error) {
+	var keys []string
+	iter := RedisClient.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if limit > 0 && len(keys) >= limit {
+			break
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("scan error: %w", err)
+	}
+
+	pipe := RedisClient.Pipeline()
+	ttls := make([]*redis.DurationCmd, len(keys))
+	sizes := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		ttls[i] = pipe.TTL(ctx, key)
+		sizes[i] = pipe.MemoryUsage(ctx, key)
+	}
+	// Per-key errors (e.g. a key expiring mid-scan) leave zero values
+	pipe.Exec(ctx)
+
+	infos := make([]KeyInfo, len(keys))
+	for i, key := range keys {
+		ttl := ttls[i].Val()
+		infos[i] = KeyInfo{Key: key, TTLSeconds: int64(ttl.Seconds()), SizeBytes: sizes[i].Val()}
+		if ttl < 0 {
+			infos[i].TTLSeconds = -1
+		}
+	}
+	return infos, nil
+}
+
+// GetRaw retrieves the stored value of a key without unmarshalling it
+func GetRaw(key string) (string, error) {
+	data, err := RedisClient.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", fmt.Errorf("cache miss")
+	}
+	if err != nil {
+		return "", fmt.Errorf("redis get error: %w", err)
+	}
+	return data, nil
+}
+
 // Exists checks if a key exists in Redis
 func Exists(key string) (bool, error) {
 	result, err := RedisClient.Exists(ctx, key).Result()
@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// setupRedis points the package at a fresh in-memory Redis for one test
+func setupRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	RedisClient = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	return mr
+}
+
+func TestTagSetsOnlyHoldLiveKeys(t *testing.T) {
+	mr := setupRedis(t)
+	if err := TagKeys([]string{"photos"}, "dkl:photos:a", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	TagKeys([]string{"photos"}, "dkl:photos:b", time.Hour)
+	TagKeys([]string{"photos"}, "dkl:photos:c", time.Minute)
+
+	members, _ := mr.ZMembers(TagKey("photos"))
+	if want := []string{"dkl:photos:c", "dkl:photos:b"}; !reflect.DeepEqual(members, want) {
+		t.Errorf("tag set %v, want %v", members, want)
+	}
+	if ttl := mr.TTL(TagKey("photos")); ttl != time.Hour {
+		t.Errorf("tag set TTL %s, want the longest key's 1h", ttl)
+	}
+}
+
+func TestTagKeysReplacesUnscoredTagSet(t *testing.T) {
+	mr := setupRedis(t)
+	mr.Set("dkl:photos:old", "x")
+	mr.SetAdd(TagKey("photos"), "dkl:photos:old")
+
+	if err := TagKeys([]string{"photos"}, "dkl:photos:new", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("dkl:photos:old") {
+		t.Error("key of the old tag set was not purged")
+	}
+	if members, _ := mr.ZMembers(TagKey("photos")); !reflect.DeepEqual(members, []string{"dkl:photos:new"}) {
+		t.Errorf("tag set %v", members)
+	}
+}
+
+func TestInvalidateGroupDeletesTagSets(t *testing.T) {
+	mr := setupRedis(t)
+	for key, tags := range map[string][]string{
+		"dkl:photos:/api/photos:":    {"photos", "photos:list"},
+		"dkl:photos:/api/photos/42:": {"photos", "photos:42"},
+		"dkl:albums:/api/albums:":    {"albums", "albums:list"},
+	} {
+		mr.Set(key, "x")
+		TagKeys(tags, key, time.Minute)
+	}
+
+	if err := InvalidateGroup("photos"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"dkl:albums:/api/albums:", TagKey("albums"), TagKey("albums:list")}
+	if keys := mr.Keys(); !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys left %v, want %v", keys, want)
+	}
+}
@@ -0,0 +1,281 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jeffreasy/dkl25/backend/lib"
+)
+
+// BruteForceConfig configures a BruteForceProtector. Zero fields get the
+// defaults in brackets.
+type BruteForceConfig struct {
+	Name string // "login", "reset-password"; part of the keys ["login"]
+
+	// Account locks an account after failures from any IP [5 failures in
+	// 15m, locked 1m doubling up to 1h]
+	Account lib.Lockout
+	// IP locks a client after failures on any account [20 failures in 15m,
+	// locked 1m doubling up to 1h]
+	IP lib.Lockout
+
+	// More than StuffingThreshold failures across all accounts within
+	// StuffingWindow looks like credential stuffing [100 per 1m]. Until it
+	// stops, IPs are locked after StuffingIPThreshold failures [5].
+	StuffingThreshold   int
+	StuffingWindow      time.Duration
+	StuffingIPThreshold int
+
+	// AccountOf returns the account of a request when it is known before the
+	// handler runs, e.g. from the path; BruteForceMiddleware then checks the
+	// account lock too. Accounts in the body are checked by the handler.
+	AccountOf func(x Exchange) string
+}
+
+// withDefaults fills in the zero fields
+func (c BruteForceConfig) withDefaults() BruteForceConfig {
+	if c.Name == "" {
+		c.Name = "login"
+	}
+	c.Account = lockoutDefaults(c.Account, 5)
+	c.IP = lockoutDefaults(c.IP, 20)
+	if c.StuffingThreshold <= 0 {
+		c.StuffingThreshold = 100
+	}
+	if c.StuffingWindow <= 0 {
+		c.StuffingWindow = time.Minute
+	}
+	if c.StuffingIPThreshold <= 0 {
+		c.StuffingIPThreshold = 5
+	}
+	return c
+}
+
+// lockoutDefaults fills in the zero fields of a lockout
+func lockoutDefaults(l lib.Lockout, threshold int) lib.Lockout {
+	if l.Threshold <= 0 {
+		l.Threshold = threshold
+	}
+	if l.Window <= 0 {
+		l.Window = 15 * time.Minute
+	}
+	if l.Base <= 0 {
+		l.Base = time.Minute
+	}
+	if l.Max <= 0 {
+		l.Max = time.Hour
+	}
+	return l
+}
+
+// BruteForceProtector guards login and password reset against guessing. The
+// handler reports every attempt: Check before verifying the credentials, then
+// Failure or Success. Its state lives in Redis, so all instances share the
+// locks; while Redis is unavailable each instance counts failures and locks
+// on its own, and keeps those locks once Redis is back.
+//
+//	if wait := protector.Check(ip, email); wait > 0 {
+//		// 429 with Retry-After
+//	}
+//	if !valid {
+//		protector.Failure(ip, email)
+//		return
+//	}
+//	protector.Success(ip, email)
+type BruteForceProtector struct {
+	config BruteForceConfig
+	local  localLockouts
+}
+
+// NewBruteForceProtector creates a protector
+func NewBruteForceProtector(config BruteForceConfig) *BruteForceProtector {
+	return &BruteForceProtector{config: config.withDefaults()}
+}
+
+// Name returns the name of the protector, e.g. "login"
+func (p *BruteForceProtector) Name() string {
+	return p.config.Name
+}
+
+// Check returns how long the account or IP is still locked; 0 means the
+// attempt may go ahead. Either may be empty.
+func (p *BruteForceProtector) Check(ip, account string) time.Duration {
+	keys := p.keys(ip, account)
+	localLock := p.local.lockedFor(keys...)
+	locked, err := lib.LockedFor(keys...)
+	if err != nil {
+		if !errors.Is(err, lib.ErrCircuitOpen) {
+			fmt.Printf("Brute force check failed, checking locally: %v\n", err)
+		}
+		return localLock
+	}
+	if localLock > locked {
+		return localLock
+	}
+	return locked
+}
+
+// Failure records a failed attempt and returns the lock it started, if any
+func (p *BruteForceProtector) Failure(ip, account string) time.Duration {
+	ipLockout := p.config.IP
+	if p.stuffing() {
+		ipLockout.Threshold = min(ipLockout.Threshold, p.config.StuffingIPThreshold)
+	}
+
+	var locked time.Duration
+	if account != "" {
+		locked = p.fail(p.accountKey(account), p.config.Account)
+	}
+	if ip != "" {
+		if ipLocked := p.fail(p.ipKey(ip), ipLockout); ipLocked > locked {
+			locked = ipLocked
+		}
+	}
+	if locked > 0 {
+		log.Printf("🔒 %s locked for %s (ip %s)", p.config.Name, locked, ip)
+	}
+	return locked
+}
+
+// fail records a failure of key in Redis, or locally while Redis is unavailable
+func (p *BruteForceProtector) fail(key string, lockout lib.Lockout) time.Duration {
+	status, err := lockout.Fail(key)
+	if err != nil {
+		if !errors.Is(err, lib.ErrCircuitOpen) {
+			fmt.Printf("Brute force failure recorded locally: %v\n", err)
+		}
+		return p.local.fail(key, lockout)
+	}
+	return status.LockedFor
+}
+
+// stuffing counts a failure across all accounts and reports whether there
+// are so many that credential stuffing is going on
+func (p *BruteForceProtector) stuffing() bool {
+	result, err := lib.FixedWindow(lib.CacheKey("auth", p.config.Name, "failures"), p.config.StuffingThreshold, p.config.StuffingWindow)
+	if err != nil || result.Allowed {
+		return false
+	}
+	// Log once per window
+	if first, _ := lib.SetNX(p.stuffingKey(), true, p.config.StuffingWindow); first {
+		log.Printf("⚠️ Credential stuffing suspected on %s: more than %d failures in %s", p.config.Name, p.config.StuffingThreshold, p.config.StuffingWindow)
+	}
+	return true
+}
+
+// Success records a successful attempt, which resets the account's failures.
+// The IP's failures stay: one valid account of their own must not let an
+// attacker keep guessing at others.
+func (p *BruteForceProtector) Success(ip, account string) {
+	if account == "" {
+		return
+	}
+	p.local.clear(p.accountKey(account))
+	if err := lib.ClearLockout(p.accountKey(account)); err != nil {
+		fmt.Printf("Brute force reset failed: %v\n", err)
+	}
+}
+
+// Unlock lifts the lock of an account or IP and forgets its failures
+func (p *BruteForceProtector) Unlock(ip, account string) error {
+	keys := p.keys(ip, account)
+	if len(keys) == 0 {
+		return nil
+	}
+	p.local.clear(keys...)
+	return lib.ClearLockout(keys...)
+}
+
+// BruteForceStatus shows the failures and locks of an account and an IP
+type BruteForceStatus struct {
+	Name                 string `json:"name"`
+	AccountFailures      int64  `json:"account_failures"`
+	AccountLockedSeconds int64  `json:"account_locked_seconds"`
+	IPFailures           int64  `json:"ip_failures"`
+	IPLockedSeconds      int64  `json:"ip_locked_seconds"`
+	Stuffing             bool   `json:"stuffing"` // credential stuffing suspected right now
+}
+
+// Status returns the state of an account and an IP; either may be empty
+func (p *BruteForceProtector) Status(ip, account string) (BruteForceStatus, error) {
+	status := BruteForceStatus{Name: p.config.Name}
+	if account != "" {
+		lockout, err := lib.GetLockout(p.accountKey(account))
+		if err != nil {
+			return status, err
+		}
+		status.AccountFailures, status.AccountLockedSeconds = lockout.Failures, lockedSeconds(lockout.LockedFor)
+	}
+	if ip != "" {
+		lockout, err := lib.GetLockout(p.ipKey(ip))
+		if err != nil {
+			return status, err
+		}
+		status.IPFailures, status.IPLockedSeconds = lockout.Failures, lockedSeconds(lockout.LockedFor)
+	}
+	stuffing, err := lib.Exists(p.stuffingKey())
+	status.Stuffing = stuffing
+	return status, err
+}
+
+// lockedSeconds rounds a lock up to whole seconds
+func lockedSeconds(locked time.Duration) int64 {
+	return int64(math.Ceil(locked.Seconds()))
+}
+
+// keys returns the lockout keys of the non-empty account and IP
+func (p *BruteForceProtector) keys(ip, account string) []string {
+	var keys []string
+	if account != "" {
+		keys = append(keys, p.accountKey(account))
+	}
+	if ip != "" {
+		keys = append(keys, p.ipKey(ip))
+	}
+	return keys
+}
+
+// accountKey hashes the account, so addresses do not end up in Redis keys
+func (p *BruteForceProtector) accountKey(account string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(account))))
+	return lib.CacheKey("auth", p.config.Name, "account", hex.EncodeToString(sum[:16]))
+}
+
+func (p *BruteForceProtector) ipKey(ip string) string {
+	return lib.CacheKey("auth", p.config.Name, "ip", ip)
+}
+
+func (p *BruteForceProtector) stuffingKey() string {
+	return lib.CacheKey("auth", p.config.Name, "stuffing")
+}
+
+// BruteForceMiddleware rejects requests from locked IPs before the handler
+// runs, e.g. on /api/auth/login. The account is usually in the body, so the
+// handler must still Check it, unless BruteForceConfig.AccountOf finds it.
+func BruteForceMiddleware(p *BruteForceProtector) func(http.Handler) http.Handler {
+	return HTTP(BruteForceEngine(p))
+}
+
+// BruteForceEngine is the transport-independent core of BruteForceMiddleware
+func BruteForceEngine(p *BruteForceProtector) Engine {
+	return func(x Exchange) {
+		var account string
+		if p.config.AccountOf != nil {
+			account = p.config.AccountOf(x)
+		}
+		if locked := p.Check(getClientIP(x), account); locked > 0 {
+			x.SetHeader("Retry-After", fmt.Sprintf("%d", retryAfterSeconds(locked)))
+			sendError(x, "Too many failed attempts. Please try again later.", http.StatusTooManyRequests)
+			return
+		}
+
+		x.Next()
+	}
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/jeffreasy/dkl25/backend/lib"
+)
+
+// localLockouts is a sharded in-process lib.Lockout, used while Redis is
+// unavailable
+type localLockouts struct {
+	shards [localShards]lockoutShard
+}
+
+type lockoutShard struct {
+	mu      sync.Mutex
+	entries map[string]*localLockout
+	inserts int
+}
+
+type localLockout struct {
+	failures    int64
+	lockedUntil time.Time
+	expires     time.Time // failures are forgotten after this
+}
+
+func (l *localLockouts) shard(key string) *lockoutShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return &l.shards[hash.Sum32()%localShards]
+}
+
+// fail counts a failure of key and returns the lock it started, if any, the
+// same way lib.Lockout.Fail does in Redis
+func (l *localLockouts) fail(key string, lockout lib.Lockout) time.Duration {
+	shard := l.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := shard.entries[key]
+	if !ok || now.After(entry.expires) {
+		if shard.entries == nil {
+			shard.entries = make(map[string]*localLockout)
+		}
+		shard.sweep(now)
+		entry = &localLockout{}
+		shard.entries[key] = entry
+	}
+
+	entry.failures++
+	var lock time.Duration
+	if entry.failures >= int64(lockout.Threshold) {
+		lock = lockout.Base
+		for i := int64(lockout.Threshold); i < entry.failures && lock < lockout.Max; i++ {
+			lock *= 2
+		}
+		if lock > lockout.Max {
+			lock = lockout.Max
+		}
+		entry.lockedUntil = now.Add(lock)
+	}
+	entry.expires = now.Add(lockout.Window + lock)
+	return lock
+}
+
+// lockedFor returns how long the longest local lock of the keys still lasts
+func (l *localLockouts) lockedFor(keys ...string) time.Duration {
+	var locked time.Duration
+	now := time.Now()
+	for _, key := range keys {
+		shard := l.shard(key)
+		shard.mu.Lock()
+		if entry, ok := shard.entries[key]; ok {
+			if remaining := entry.lockedUntil.Sub(now); remaining > locked {
+				locked = remaining
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return locked
+}
+
+// clear forgets the failures and lifts the locks of the keys
+func (l *localLockouts) clear(keys ...string) {
+	for _, key := range keys {
+		shard := l.shard(key)
+		shard.mu.Lock()
+		delete(shard.entries, key)
+		shard.mu.Unlock()
+	}
+}
+
+// sweep drops expired entries every 1024 new keys
+func (s *lockoutShard) sweep(now time.Time) {
+	if s.inserts++; s.inserts%1024 != 0 {
+		return
+	}
+	for key, entry := range s.entries {
+		if now.After(entry.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
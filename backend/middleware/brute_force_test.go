@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffreasy/dkl25/backend/lib"
+)
+
+func TestBruteForceLocksLocallyWithoutRedis(t *testing.T) {
+	mr := setupRedis(t)
+	old := lib.RateLimitCircuit
+	lib.RateLimitCircuit = &lib.Circuit{Name: "test", Threshold: 1, Cooldown: time.Hour}
+	defer func() { lib.RateLimitCircuit = old }()
+
+	p := NewBruteForceProtector(BruteForceConfig{
+		Account: lib.Lockout{Threshold: 2, Base: time.Minute},
+		IP:      lib.Lockout{Threshold: 3, Base: time.Minute},
+	})
+	mr.Close()
+
+	if locked := p.Failure("1.1.1.1", "jan@example.com"); locked != 0 {
+		t.Fatalf("first failure locked for %s", locked)
+	}
+	if locked := p.Failure("2.2.2.2", "jan@example.com"); locked != time.Minute {
+		t.Fatalf("second failure locked for %s, want 1m", locked)
+	}
+	if locked := p.Failure("3.3.3.3", "jan@example.com"); locked != 2*time.Minute {
+		t.Fatalf("third failure locked for %s, want 2m", locked)
+	}
+	if locked := p.Check("4.4.4.4", "JAN@example.com "); locked <= time.Minute {
+		t.Errorf("account locked for %s, want about 2m", locked)
+	}
+	if locked := p.Check("4.4.4.4", "piet@example.com"); locked != 0 {
+		t.Errorf("other account locked for %s", locked)
+	}
+
+	p.Success("1.1.1.1", "jan@example.com")
+	if locked := p.Check("", "jan@example.com"); locked != 0 {
+		t.Errorf("account still locked for %s after a success", locked)
+	}
+}
+
+func TestBruteForceMiddlewareChecksKnownAccount(t *testing.T) {
+	setupRedis(t)
+	p := NewBruteForceProtector(BruteForceConfig{
+		Name:    "reset-password",
+		Account: lib.Lockout{Threshold: 1},
+		AccountOf: func(x Exchange) string {
+			return strings.TrimPrefix(x.Path(), "/api/auth/reset-password/")
+		},
+	})
+	handler := BruteForceMiddleware(p)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	status := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", path, nil))
+		return rec.Code, rec.Header().Get("Retry-After")
+	}
+
+	p.Failure("1.1.1.1", "jan")
+	if code, retry := status("/api/auth/reset-password/jan"); code != http.StatusTooManyRequests || retry != "60" {
+		t.Errorf("locked account: %d Retry-After %q, want 429 after 60s", code, retry)
+	}
+	if code, _ := status("/api/auth/reset-password/piet"); code != http.StatusOK {
+		t.Errorf("other account: %d, want 200", code)
+	}
+}
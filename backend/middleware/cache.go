@@ -4,8 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jeffreasy/dkl25/backend/lib"
@@ -13,153 +14,497 @@ import (
 
 // CacheConfig holds cache configuration
 type CacheConfig struct {
-	TTL    time.Duration
-	Prefix string
+	TTL     time.Duration
+	SoftTTL time.Duration // after this age the next request refreshes the entry; 0 disables
+	Prefix  string
+	Vary    []string // request headers that are part of the cache key
+	Tags    []string // tags the entry is recorded under for invalidation
+	Bypass  CacheBypass
+
+	// Version namespaces the keys; empty uses the build version from
+	// lib.CacheVersion. Pin it to keep entries across deploys.
+	Version string
+
+	// QueryAllowlist limits the query parameters in the cache key; empty keeps
+	// all. Requests with a parameter that is neither allowed nor denied
+	// bypass the cache. QueryDenylist removes parameters from the key; nil
+	// uses DefaultQueryDenylist.
+	QueryAllowlist []string
+	QueryDenylist  []string
+
+	// CompressMinSize is the smallest body stored with gzip and brotli
+	// variants. 0 uses DefaultCompressMinSize, negative disables compression.
+	CompressMinSize int
+
+	// MaxBodySize is the largest body buffered for caching; larger bodies
+	// are streamed through uncached. 0 uses DefaultMaxCacheBodySize.
+	MaxBodySize int
+
+	// NegativeTTL caches 404 and 410 responses for this long; 0 disables.
+	// With CacheEmptyLists, 200 responses that are an empty list (see
+	// IsEmptyResult) are cached for NegativeTTL as well.
+	NegativeTTL     time.Duration
+	CacheEmptyLists bool
+	IsEmptyResult   func(body []byte) bool // nil uses isEmptyJSONList
+
+	// RefreshAhead recomputes hot entries shortly before they expire using
+	// XFetch; RefreshBeta tunes how early (0 uses DefaultRefreshBeta).
+	RefreshAhead bool
+	RefreshBeta  float64
+
+	// TTLJitter shortens each entry's TTL by a random share of up to this
+	// fraction (0.1 = 10%) so entries written together expire apart
+	TTLJitter float64
+
+	// CORSOrigins are the origins whose CORS headers are cached, each under a
+	// key of its own. Other requests share one entry, stored without
+	// origin-specific CORS headers; set those in a CORS middleware outside
+	// the cache to have them on hits too.
+	CORSOrigins []string
+
+	// TTLFunc computes the TTL of a regular (non-negative) response from the
+	// request and body, e.g. to expire at the next schedule change. Results
+	// <= 0 fall back to TTL.
+	TTLFunc func(x Exchange, body []byte) time.Duration
+}
+
+// cachedResponse is the value stored in Redis for a cached response, see
+// encodeEntry. The bodies are stored raw after the JSON metadata.
+type cachedResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type"`
+	Body        []byte `json:"-"`
+	Gzip        []byte `json:"-"`
+	Brotli      []byte `json:"-"`
+	StoredAt    int64  `json:"stored_at"`
+	ExpiresAtMS int64  `json:"expires_at_ms,omitempty"`
+	ComputeMS   int64  `json:"compute_ms,omitempty"` // handler time, used by refresh-ahead
+	Negative    bool   `json:"negative,omitempty"`   // 404/410 or empty result
+
+	Headers map[string]string `json:"headers,omitempty"` // see replayedHeaders
+}
+
+// replayedHeaders are the response headers stored with an entry and sent
+// again on a hit, next to Content-Type
+var replayedHeaders = []string{
+	"Cache-Control",
+	"ETag",
+	"Last-Modified",
+	"Access-Control-Allow-Origin",
+	"Access-Control-Allow-Credentials",
+	"Access-Control-Allow-Headers",
+	"Access-Control-Allow-Methods",
+	"Access-Control-Expose-Headers",
+	"Access-Control-Max-Age",
+}
+
+// responseHeaders returns the replayed headers the handler set. CORS headers
+// are left out unless the key varies by the request's origin or they allow
+// any origin, so one origin's headers are never served to another.
+func responseHeaders(x Exchange, config CacheConfig) map[string]string {
+	keepCORS := corsOrigin(x, config) != "" || x.ResponseHeader("Access-Control-Allow-Origin") == "*"
+	headers := make(map[string]string)
+	for _, name := range replayedHeaders {
+		if !keepCORS && strings.HasPrefix(name, "Access-Control-") {
+			continue
+		}
+		if value := x.ResponseHeader(name); value != "" {
+			headers[name] = value
+		}
+	}
+	return headers
 }
 
 // CacheMiddleware provides HTTP response caching for GET requests
 func CacheMiddleware(config CacheConfig) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Only cache GET requests
-			if r.Method != http.MethodGet {
-				next.ServeHTTP(w, r)
-				return
-			}
+	return HTTP(CacheEngine(config))
+}
 
-			// Generate cache key from path and query
-			cacheKey := lib.CacheKey(config.Prefix, r.URL.Path, r.URL.RawQuery)
-
-			// Try to get from cache
-			var cachedData map[string]interface{}
-			err := lib.GetCache(cacheKey, &cachedData)
-			if err == nil {
-				// Cache hit - return cached response
-				w.Header().Set("Content-Type", "application/json")
-				w.Header().Set("X-Cache", "HIT")
-				w.Header().Set("X-Cache-Key", cacheKey)
-				w.WriteHeader(http.StatusOK)
-				json.NewEncoder(w).Encode(cachedData)
+// CacheEngine is the transport-independent core of CacheMiddleware
+func CacheEngine(config CacheConfig) Engine {
+	return func(x Exchange) {
+		// Only cache GET requests (HEAD is answered from cache when possible).
+		// WebSocket upgrades and event streams pass straight through.
+		if x.Method() != http.MethodGet && x.Method() != http.MethodHead || isStreamingRequest(x) {
+			x.Next()
+			return
+		}
+
+		metrics := metricsFor(config.Prefix)
+		diag := diagnosticsFrom(x.Context())
+
+		if shouldBypassCache(x, config.Bypass) || hasUnlistedParam(x.RawQuery(), config.QueryAllowlist, queryDenylist(config)) {
+			metrics.bypass.Add(1)
+			x.SetHeader("X-Cache", "BYPASS")
+			x.Next()
+			return
+		}
+
+		if len(config.Vary) > 0 {
+			x.AddHeader("Vary", strings.Join(config.Vary, ", "))
+		}
+
+		// Generate cache key from path, normalized query and vary headers
+		lookupStart := time.Now()
+		cacheKey := cacheKeyFor(x, config)
+		diag.Set("X-Cache-Key", cacheKey)
+
+		// Try to get from cache
+		redisStart := time.Now()
+		cached, err := loadEntry(cacheKey)
+		diag.Add("redis", "", time.Since(redisStart))
+		diag.Add("cache", "lookup", time.Since(lookupStart))
+		if err == nil {
+			now := time.Now()
+			stale := config.SoftTTL > 0 && !cached.Negative && now.Sub(time.Unix(cached.StoredAt, 0)) > config.SoftTTL
+			early := !stale && config.RefreshAhead && !cached.Negative && shouldRefreshEarly(cached, config.RefreshBeta, now)
+			// A stale or early-expired entry is refreshed by the one request
+			// that wins the refresh lock; everyone else keeps getting the copy
+			if !(stale || early) || !acquireRefreshLock(cacheKey, diag) {
+				status := "HIT"
+				switch {
+				case cached.Negative:
+					metrics.negativeHits.Add(1)
+				case stale:
+					status = "STALE"
+					metrics.stale.Add(1)
+				default:
+					metrics.hits.Add(1)
+				}
+				setSurrogateHeaders(x, config, remainingTTL(config, cached, now))
+				writeCachedResponse(x, cached, status)
 				return
 			}
-
-			// Cache miss - create response recorder
-			rec := &ResponseRecorder{
-				ResponseWriter: w,
-				statusCode:     http.StatusOK,
-				body:           &bytes.Buffer{},
+			if early {
+				metrics.earlyRefreshes.Add(1)
 			}
+			defer lib.DeleteCache(refreshLockKey(cacheKey))
+		}
+		metrics.misses.Add(1)
 
-			// Call next handler
-			next.ServeHTTP(rec, r)
-
-			// Only cache successful responses
-			if rec.statusCode == http.StatusOK && rec.body.Len() > 0 {
-				var responseData map[string]interface{}
-				if err := json.Unmarshal(rec.body.Bytes(), &responseData); err == nil {
-					// Cache the response
-					if err := lib.SetCache(cacheKey, responseData, config.TTL); err == nil {
-						w.Header().Set("X-Cache", "MISS")
-						w.Header().Set("X-Cache-Key", cacheKey)
-					}
-				}
+		if x.Method() == http.MethodHead {
+			x.Next()
+			return
+		}
+
+		// Cache miss - capture the response. X-Cache is set up front
+		// because a streamed response sends its headers mid-handler.
+		x.SetHeader("X-Cache", "MISS")
+		start := time.Now()
+		statusCode, body, buffered := x.Capture(config.MaxBodySize)
+		computeTime := time.Since(start)
+		diag.Add("app", "handler", computeTime)
+
+		// Streamed responses have been sent already and are not cached
+		if !buffered {
+			return
+		}
+
+		// Only cache successful JSON responses (and, when enabled, negative
+		// results) the handler did not encode itself
+		negative := isNegativeResult(config, statusCode, body)
+		cacheable := negative || statusCode == http.StatusOK && len(body) > 0 && json.Valid(body)
+		if !cacheable || x.ResponseHeader("Content-Encoding") != "" {
+			x.Send(statusCode, body)
+			return
+		}
+
+		entry := cachedResponse{
+			Status:      statusCode,
+			ContentType: x.ResponseHeader("Content-Type"),
+			Headers:     responseHeaders(x, config),
+			Body:        body,
+			StoredAt:    time.Now().Unix(),
+			ComputeMS:   computeTime.Milliseconds() + 1, // rounded up so fast handlers count
+			Negative:    negative,
+		}
+		compressVariants(&entry, config.CompressMinSize)
+
+		// Negative entries share the key and tags of regular entries, so
+		// writes to the resource purge them the same way
+		ttl := entryTTL(config, entry)
+		if !negative && config.TTLFunc != nil {
+			if computed := config.TTLFunc(x, entry.Body); computed > 0 {
+				ttl = computed
+			}
+		}
+		ttl = jitterTTL(ttl, config.TTLJitter)
+		entry.ExpiresAtMS = time.Now().Add(ttl).UnixMilli()
+		redisStart = time.Now()
+		if err := lib.SetBytes(cacheKey, encodeEntry(entry), ttl); err == nil {
+			if negative {
+				metrics.negativeStores.Add(1)
+			} else {
+				metrics.stores.Add(1)
+			}
+			if err := lib.TagKeys(config.Tags, cacheKey, ttl); err != nil {
+				fmt.Printf("Cache tagging error for key %s: %v\n", cacheKey, err)
 			}
+		} else {
+			metrics.storeErrors.Add(1)
+		}
+		diag.Add("redis", "", time.Since(redisStart))
 
-			// Write the response
-			w.Header().Set("X-Cache", "MISS")
-			w.WriteHeader(rec.statusCode)
-			w.Write(rec.body.Bytes())
-		})
+		// Write the response in the encoding this client prefers
+		setSurrogateHeaders(x, config, ttl)
+		writeCachedResponse(x, entry, "MISS")
 	}
 }
 
-// ResponseRecorder records HTTP response for caching
-type ResponseRecorder struct {
-	http.ResponseWriter
-	statusCode int
-	body       *bytes.Buffer
+// isNegativeResult reports whether a response is a "not found" or empty
+// result that is cached for NegativeTTL
+func isNegativeResult(config CacheConfig, status int, body []byte) bool {
+	if config.NegativeTTL <= 0 {
+		return false
+	}
+	if status == http.StatusNotFound || status == http.StatusGone {
+		return true
+	}
+	if status != http.StatusOK || !config.CacheEmptyLists {
+		return false
+	}
+	isEmpty := config.IsEmptyResult
+	if isEmpty == nil {
+		isEmpty = isEmptyJSONList
+	}
+	return isEmpty(body)
 }
 
-// Write captures the response body
-func (r *ResponseRecorder) Write(b []byte) (int, error) {
-	r.body.Write(b)
-	return r.ResponseWriter.Write(b)
+// isEmptyJSONList reports whether body is an empty JSON array or null
+func isEmptyJSONList(body []byte) bool {
+	trimmed := strings.Join(strings.Fields(string(body)), "")
+	return trimmed == "[]" || trimmed == "null"
 }
 
-// WriteHeader captures the status code
-func (r *ResponseRecorder) WriteHeader(statusCode int) {
-	r.statusCode = statusCode
-	r.ResponseWriter.WriteHeader(statusCode)
+// entryTTL returns how long an entry is kept
+func entryTTL(config CacheConfig, entry cachedResponse) time.Duration {
+	if entry.Negative {
+		return config.NegativeTTL
+	}
+	return config.TTL
 }
 
-// SmartCacheMiddleware provides intelligent caching based on content type
-func SmartCacheMiddleware() func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Only cache GET requests
-			if r.Method != http.MethodGet {
-				next.ServeHTTP(w, r)
-				return
-			}
+// remainingTTL returns how long a cached entry still lives
+func remainingTTL(config CacheConfig, entry cachedResponse, now time.Time) time.Duration {
+	if entry.ExpiresAtMS == 0 {
+		return entryTTL(config, entry)
+	}
+	if remaining := time.Duration(entry.ExpiresAtMS-now.UnixMilli()) * time.Millisecond; remaining > 0 {
+		return remaining
+	}
+	return 0
+}
 
-			// Determine TTL based on path
-			var ttl time.Duration
-			var prefix string
-
-			switch {
-			case contains(r.URL.Path, "/partners"):
-				ttl = 1 * time.Hour
-				prefix = "partners"
-			case contains(r.URL.Path, "/photos"):
-				ttl = 30 * time.Minute
-				prefix = "photos"
-			case contains(r.URL.Path, "/albums"):
-				ttl = 30 * time.Minute
-				prefix = "albums"
-			case contains(r.URL.Path, "/program-schedule"):
-				ttl = 2 * time.Hour
-				prefix = "program"
-			case contains(r.URL.Path, "/social"):
-				ttl = 15 * time.Minute
-				prefix = "social"
-			default:
-				// No caching for unknown endpoints
-				next.ServeHTTP(w, r)
-				return
-			}
+// CacheEntryInfo is a decoded cache entry for inspection
+type CacheEntryInfo struct {
+	Key         string          `json:"key"`
+	Status      int             `json:"status"`
+	ContentType string          `json:"content_type"`
+	StoredAt    time.Time       `json:"stored_at"`
+	SizeBytes   int             `json:"size_bytes"`
+	GzipBytes   int             `json:"gzip_bytes,omitempty"`
+	BrotliBytes int             `json:"brotli_bytes,omitempty"`
+	Negative    bool            `json:"negative,omitempty"`
+	Body        json.RawMessage `json:"body"`
+}
 
-			// Use cache middleware with determined settings
-			cacheMiddleware := CacheMiddleware(CacheConfig{
-				TTL:    ttl,
-				Prefix: prefix,
-			})
+// InspectCacheEntry loads and decodes a cached response
+func InspectCacheEntry(key string) (CacheEntryInfo, error) {
+	cached, err := loadEntry(key)
+	if err != nil {
+		return CacheEntryInfo{}, err
+	}
 
-			cacheMiddleware(next).ServeHTTP(w, r)
-		})
+	info := CacheEntryInfo{
+		Key:         key,
+		Status:      cached.Status,
+		ContentType: cached.ContentType,
+		StoredAt:    time.Unix(cached.StoredAt, 0),
+		SizeBytes:   len(cached.Body),
+		GzipBytes:   len(cached.Gzip),
+		BrotliBytes: len(cached.Brotli),
+		Negative:    cached.Negative,
+		Body:        cached.Body,
+	}
+	if !json.Valid(cached.Body) {
+		info.Body, _ = json.Marshal(string(cached.Body))
 	}
+	return info, nil
 }
 
-// CacheInvalidationMiddleware adds cache invalidation for write operations
-func CacheInvalidationMiddleware(patterns ...string) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Call next handler first
-			next.ServeHTTP(w, r)
+// storedEntry is the metadata of a stored entry with the sizes of the raw
+// bodies that follow it
+type storedEntry struct {
+	cachedResponse
+	BodySize   int `json:"body_size"`
+	GzipSize   int `json:"gzip_size,omitempty"`
+	BrotliSize int `json:"br_size,omitempty"`
+}
 
-			// Invalidate cache for POST, PUT, DELETE operations
-			if r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodDelete {
-				for _, pattern := range patterns {
-					cachePattern := lib.CacheKey(pattern, "*")
-					if err := lib.InvalidatePattern(cachePattern); err != nil {
-						// Log error but don't fail the request
-						fmt.Printf("Cache invalidation error for pattern %s: %v\n", cachePattern, err)
-					}
-				}
+// encodeEntry stores an entry as a line of JSON metadata followed by the
+// body and its compressed variants as raw bytes, so they are not inflated by
+// base64 as []byte fields in JSON would be
+func encodeEntry(entry cachedResponse) []byte {
+	header, _ := json.Marshal(storedEntry{
+		cachedResponse: entry,
+		BodySize:       len(entry.Body),
+		GzipSize:       len(entry.Gzip),
+		BrotliSize:     len(entry.Brotli),
+	})
 
-				// Add header to indicate cache was invalidated
-				w.Header().Set("X-Cache-Invalidated", "true")
-			}
-		})
+	data := make([]byte, 0, len(header)+1+len(entry.Body)+len(entry.Gzip)+len(entry.Brotli))
+	data = append(data, header...)
+	data = append(data, '\n')
+	data = append(data, entry.Body...)
+	data = append(data, entry.Gzip...)
+	return append(data, entry.Brotli...)
+}
+
+// decodeEntry reads an entry written by encodeEntry. JSON escapes newlines,
+// so the first one ends the metadata.
+func decodeEntry(data []byte) (cachedResponse, error) {
+	header, bodies, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return cachedResponse{}, fmt.Errorf("cache entry in an unknown format")
+	}
+	var stored storedEntry
+	if err := json.Unmarshal(header, &stored); err != nil {
+		return cachedResponse{}, fmt.Errorf("cache entry: %w", err)
+	}
+	if stored.BodySize+stored.GzipSize+stored.BrotliSize != len(bodies) {
+		return cachedResponse{}, fmt.Errorf("cache entry is truncated")
+	}
+
+	entry := stored.cachedResponse
+	entry.Body, bodies = bodies[:stored.BodySize], bodies[stored.BodySize:]
+	if stored.GzipSize > 0 {
+		entry.Gzip, bodies = bodies[:stored.GzipSize], bodies[stored.GzipSize:]
+	}
+	if stored.BrotliSize > 0 {
+		entry.Brotli = bodies[:stored.BrotliSize]
+	}
+	return entry, nil
+}
+
+// loadEntry reads a cached response. Entries in an older format fail to
+// decode and count as a miss, so they are replaced on the next request.
+func loadEntry(key string) (cachedResponse, error) {
+	data, err := lib.GetBytes(key)
+	if err != nil {
+		return cachedResponse{}, err
+	}
+	return decodeEntry(data)
+}
+
+// writeCachedResponse writes a cached entry to the client
+func writeCachedResponse(x Exchange, cached cachedResponse, status string) {
+	contentType := cached.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	encoding, body := selectVariant(x.Header("Accept-Encoding"), cached)
+
+	x.SetHeader("Content-Type", contentType)
+	for name, value := range cached.Headers {
+		x.SetHeader(name, value)
+	}
+	// CORS answering with the request's origin varies by it
+	if origin := cached.Headers["Access-Control-Allow-Origin"]; origin != "" && origin != "*" && !strings.Contains(x.ResponseHeader("Vary"), "Origin") {
+		x.AddHeader("Vary", "Origin")
+	}
+	if cached.Gzip != nil || cached.Brotli != nil {
+		x.AddHeader("Vary", "Accept-Encoding")
+	}
+	if encoding != "" {
+		x.SetHeader("Content-Encoding", encoding)
+	}
+	x.SetHeader("Content-Length", strconv.Itoa(len(body)))
+	x.SetHeader("X-Cache", status)
+	x.Send(cached.Status, body)
+}
+
+// refreshLockKey is held by the request refreshing a stale entry
+func refreshLockKey(cacheKey string) string {
+	return cacheKey + ":refresh"
+}
+
+// acquireRefreshLock reports whether this request should refresh a stale entry
+func acquireRefreshLock(cacheKey string, diag *Diagnostics) bool {
+	start := time.Now()
+	ok, err := lib.SetNX(refreshLockKey(cacheKey), 1, 30*time.Second)
+	diag.Add("redis", "", time.Since(start))
+	return err == nil && ok
+}
+
+// varyKeyParts returns the cache key parts for the vary headers
+func varyKeyParts(x Exchange, vary []string) []string {
+	parts := make([]string, 0, len(vary))
+	for _, header := range vary {
+		parts = append(parts, strings.ToLower(header)+"="+x.Header(header))
+	}
+	return parts
+}
+
+// shouldBypassCache reports whether the request matches any bypass rule
+func shouldBypassCache(x Exchange, bypass CacheBypass) bool {
+	for _, header := range bypass.Headers {
+		if x.Header(header) != "" {
+			return true
+		}
+	}
+	for _, param := range bypass.Query {
+		if queryHas(x, param) {
+			return true
+		}
+	}
+	for _, name := range bypass.Cookies {
+		if _, ok := x.Cookie(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultCachePolicies is used by SmartCacheMiddleware and when no table is given
+var defaultCachePolicies, _ = NewCachePolicyTable(DefaultCachePolicies())
+
+// SmartCacheMiddleware caches responses according to DefaultCachePolicies
+func SmartCacheMiddleware() func(http.Handler) http.Handler {
+	return SmartCacheWithPolicies(nil)
+}
+
+// SmartCacheWithPolicies caches responses according to a route policy table.
+// A nil table uses DefaultCachePolicies.
+func SmartCacheWithPolicies(policies *CachePolicyTable) func(http.Handler) http.Handler {
+	return HTTP(SmartCacheEngine(policies))
+}
+
+// SmartCacheEngine is the transport-independent core of SmartCacheWithPolicies
+func SmartCacheEngine(policies *CachePolicyTable) Engine {
+	if policies == nil {
+		policies = defaultCachePolicies
+	}
+
+	return func(x Exchange) {
+		// Only cache GET requests, never upgrades or event streams
+		if x.Method() != http.MethodGet && x.Method() != http.MethodHead || isStreamingRequest(x) {
+			x.Next()
+			return
+		}
+
+		policy, params, ok := policies.Match(x.Method(), x.Path())
+		if !ok {
+			// No caching for unknown endpoints
+			x.Next()
+			return
+		}
+
+		// Use the cache engine with the policy settings, tagging the entry
+		// with its resource so single-resource writes can purge it
+		config := policy.CacheConfig()
+		diagnosticsFrom(x.Context()).Set("X-Cache-Policy", policy.Name)
+		config.Tags = append(config.Tags[:len(config.Tags):len(config.Tags)], resourceTags(policy.Prefix, params)...)
+		CacheEngine(config)(x)
 	}
 }
 
@@ -182,13 +527,6 @@ func ConditionalCacheMiddleware(shouldCache func(*http.Request) (bool, CacheConf
 	}
 }
 
-// Helper function to check if string contains substring
-func contains(s, substr string) bool {
-	return len(s) >= len(substr) && s[:len(substr)] == substr ||
-		len(s) > len(substr) && s[len(s)-len(substr):] == substr ||
-		bytes.Contains([]byte(s), []byte(substr))
-}
-
 // CacheControl headers middleware
 func CacheControlMiddleware(maxAge time.Duration) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -211,18 +549,3 @@ func NoCacheMiddleware() func(http.Handler) http.Handler {
 		})
 	}
 }
-
-// WarmCache pre-populates cache with common requests
-func WarmCache(baseURL string, endpoints []string, client *http.Client) error {
-	for _, endpoint := range endpoints {
-		resp, err := client.Get(baseURL + endpoint)
-		if err != nil {
-			return fmt.Errorf("failed to warm cache for %s: %w", endpoint, err)
-		}
-		defer resp.Body.Close()
-
-		// Read and discard body to trigger caching
-		io.Copy(io.Discard, resp.Body)
-	}
-	return nil
-}
@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Purger removes cached content from a CDN by surrogate key / cache tag
+type Purger interface {
+	PurgeTags(ctx context.Context, tags []string) error
+}
+
+// PurgeStyle selects the purge API an HTTPPurger speaks
+type PurgeStyle string
+
+const (
+	// PurgeStyleFastly sends the keys in a Surrogate-Key header (Fastly, Varnish xkey)
+	PurgeStyleFastly PurgeStyle = "fastly"
+	// PurgeStyleCloudflare sends {"tags": [...]} as JSON (Cloudflare purge_cache)
+	PurgeStyleCloudflare PurgeStyle = "cloudflare"
+)
+
+// HTTPPurger purges CDN content through an HTTP purge API
+type HTTPPurger struct {
+	Endpoint string // full purge URL, e.g. https://api.fastly.com/service/<id>/purge
+	Token    string // API token
+	Style    PurgeStyle
+	Client   *http.Client
+}
+
+// PurgeTags asks the CDN to drop everything tagged with any of the tags
+func (p *HTTPPurger) PurgeTags(ctx context.Context, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	var req *http.Request
+	var err error
+	switch p.Style {
+	case PurgeStyleCloudflare:
+		body, _ := json.Marshal(map[string][]string{"tags": tags})
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, p.Endpoint, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("purge request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if p.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+p.Token)
+		}
+	case PurgeStyleFastly, "":
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, p.Endpoint, nil)
+		if err != nil {
+			return fmt.Errorf("purge request: %w", err)
+		}
+		req.Header.Set("Surrogate-Key", strings.Join(tags, " "))
+		if p.Token != "" {
+			req.Header.Set("Fastly-Key", p.Token)
+		}
+	default:
+		return fmt.Errorf("unknown purge style %q", p.Style)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("purge request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("purge request returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+var (
+	purgerMu    sync.RWMutex
+	cachePurger Purger
+)
+
+// SetPurger configures the CDN purger used by CacheInvalidationMiddleware.
+// Passing nil disables CDN purging.
+func SetPurger(p Purger) {
+	purgerMu.Lock()
+	defer purgerMu.Unlock()
+	cachePurger = p
+}
+
+// purgeCDN purges tags from the configured CDN in the background
+func purgeCDN(tags []string) {
+	purgerMu.RLock()
+	p := cachePurger
+	purgerMu.RUnlock()
+
+	if p == nil || len(tags) == 0 {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		if err := p.PurgeTags(ctx, tags); err != nil {
+			fmt.Printf("CDN purge error for tags %v: %v\n", tags, err)
+		}
+	}()
+}
+
+// setSurrogateHeaders tells a CDN how long to keep the response and which
+// keys purge it. The prefix is always a key so prefix purges reach the CDN.
+func setSurrogateHeaders(x Exchange, config CacheConfig, ttl time.Duration) {
+	keys := surrogateKeys(config)
+	x.SetHeader("Surrogate-Key", strings.Join(keys, " "))
+	x.SetHeader("Cache-Tag", strings.Join(keys, ","))
+	x.SetHeader("Surrogate-Control", fmt.Sprintf("max-age=%d", int(ttl.Seconds())))
+}
+
+// surrogateKeys returns the prefix followed by the configured tags, without duplicates
+func surrogateKeys(config CacheConfig) []string {
+	keys := []string{config.Prefix}
+	for _, tag := range config.Tags {
+		if tag != config.Prefix {
+			keys = append(keys, tag)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePurge is a request received by the fake purge server
+type fakePurge struct {
+	header http.Header
+	body   string
+}
+
+// fakePurgeServer records purge requests and answers with status
+func fakePurgeServer(t *testing.T, status int) (*httptest.Server, chan fakePurge) {
+	t.Helper()
+	received := make(chan fakePurge, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- fakePurge{header: r.Header.Clone(), body: string(body)}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func TestHTTPPurgerFastly(t *testing.T) {
+	server, received := fakePurgeServer(t, http.StatusOK)
+	purger := &HTTPPurger{Endpoint: server.URL, Token: "secret", Style: PurgeStyleFastly}
+
+	if err := purger.PurgeTags(context.Background(), []string{"photos", "photos:id:7"}); err != nil {
+		t.Fatal(err)
+	}
+	got := <-received
+	if got.header.Get("Surrogate-Key") != "photos photos:id:7" {
+		t.Errorf("Surrogate-Key = %q", got.header.Get("Surrogate-Key"))
+	}
+	if got.header.Get("Fastly-Key") != "secret" {
+		t.Errorf("Fastly-Key = %q", got.header.Get("Fastly-Key"))
+	}
+}
+
+func TestHTTPPurgerCloudflare(t *testing.T) {
+	server, received := fakePurgeServer(t, http.StatusOK)
+	purger := &HTTPPurger{Endpoint: server.URL, Token: "secret", Style: PurgeStyleCloudflare}
+
+	if err := purger.PurgeTags(context.Background(), []string{"photos", "albums"}); err != nil {
+		t.Fatal(err)
+	}
+	got := <-received
+	var body struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.Unmarshal([]byte(got.body), &body); err != nil || strings.Join(body.Tags, ",") != "photos,albums" {
+		t.Errorf("body = %s", got.body)
+	}
+	if got.header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("Authorization = %q", got.header.Get("Authorization"))
+	}
+	if got.header.Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type = %q", got.header.Get("Content-Type"))
+	}
+}
+
+func TestHTTPPurgerErrorStatus(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusInternalServerError} {
+		server, _ := fakePurgeServer(t, status)
+		purger := &HTTPPurger{Endpoint: server.URL, Style: PurgeStyleFastly}
+		if err := purger.PurgeTags(context.Background(), []string{"photos"}); err == nil {
+			t.Errorf("status %d: no error", status)
+		}
+	}
+}
+
+func TestWritePurgesCDN(t *testing.T) {
+	setupRedis(t)
+	server, received := fakePurgeServer(t, http.StatusOK)
+	SetPurger(&HTTPPurger{Endpoint: server.URL, Style: PurgeStyleFastly})
+	t.Cleanup(func() { SetPurger(nil) })
+
+	dependencies := NewCacheDependencyGraph()
+	dependencies.Add("photos", "albums")
+	status := http.StatusCreated
+	handler := CacheInvalidationWithConfig(InvalidationConfig{Groups: []string{"photos"}, Dependencies: dependencies})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(status) }))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/photos", nil))
+	select {
+	case got := <-received:
+		if got.header.Get("Surrogate-Key") != "photos albums" {
+			t.Errorf("Surrogate-Key = %q", got.header.Get("Surrogate-Key"))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("successful write did not purge the CDN")
+	}
+
+	// A failed write purges nothing
+	status = http.StatusInternalServerError
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/photos", nil))
+	select {
+	case got := <-received:
+		t.Fatalf("failed write purged %q", got.header.Get("Surrogate-Key"))
+	case <-time.After(200 * time.Millisecond):
+	}
+}
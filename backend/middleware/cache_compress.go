@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// DefaultCompressMinSize is the smallest body that gets compressed variants.
+// Smaller bodies gain little and are stored and served uncompressed.
+const DefaultCompressMinSize = 1024
+
+// brotliLevel compresses about as well as gzip -9 at a fraction of the
+// time of brotli's best level 11
+const brotliLevel = 5
+
+// Content encodings stored alongside a cached body
+const (
+	encodingIdentity = "identity"
+	encodingGzip     = "gzip"
+	encodingBrotli   = "br"
+)
+
+// compressVariants fills the gzip and brotli variants of a cached entry when
+// the body is at least minSize bytes. A negative minSize disables compression.
+// It runs on the miss path, so it uses moderate levels: the best levels cost
+// far more time for a few percent less.
+func compressVariants(entry *cachedResponse, minSize int) {
+	if minSize == 0 {
+		minSize = DefaultCompressMinSize
+	}
+	if minSize < 0 || len(entry.Body) < minSize {
+		return
+	}
+
+	var gz bytes.Buffer
+	gzw, _ := gzip.NewWriterLevel(&gz, gzip.DefaultCompression)
+	if _, err := gzw.Write(entry.Body); err == nil && gzw.Close() == nil && gz.Len() < len(entry.Body) {
+		entry.Gzip = gz.Bytes()
+	}
+
+	var br bytes.Buffer
+	brw := brotli.NewWriterLevel(&br, brotliLevel)
+	if _, err := brw.Write(entry.Body); err == nil && brw.Close() == nil && br.Len() < len(entry.Body) {
+		entry.Brotli = br.Bytes()
+	}
+}
+
+// selectVariant picks the best stored encoding the client accepts and returns
+// its Content-Encoding value ("" for identity) and body
+func selectVariant(acceptEncoding string, entry cachedResponse) (string, []byte) {
+	if entry.Brotli == nil && entry.Gzip == nil {
+		return "", entry.Body
+	}
+
+	accepted := parseAcceptEncoding(acceptEncoding)
+
+	// Prefer the highest q-value; on ties prefer brotli, then gzip, then identity
+	best, bestQ := encodingIdentity, accepted.q(encodingIdentity)
+	if entry.Gzip != nil {
+		if q := accepted.q(encodingGzip); q > bestQ || (q == bestQ && q > 0) {
+			best, bestQ = encodingGzip, q
+		}
+	}
+	if entry.Brotli != nil {
+		if q := accepted.q(encodingBrotli); q > bestQ || (q == bestQ && q > 0) {
+			best = encodingBrotli
+		}
+	}
+
+	switch best {
+	case encodingBrotli:
+		return encodingBrotli, entry.Brotli
+	case encodingGzip:
+		return encodingGzip, entry.Gzip
+	default:
+		return "", entry.Body
+	}
+}
+
+// acceptEncodings maps content codings to q-values from an Accept-Encoding header
+type acceptEncodings map[string]float64
+
+// parseAcceptEncoding parses an Accept-Encoding header such as "br;q=1.0, gzip;q=0.8, *;q=0"
+func parseAcceptEncoding(header string) acceptEncodings {
+	accepted := make(acceptEncodings)
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = parsed
+			}
+		}
+		accepted[coding] = q
+	}
+	return accepted
+}
+
+// q returns the q-value for a coding. Identity is acceptable unless excluded
+// explicitly or through "*;q=0"; other codings must be listed or matched by "*".
+func (a acceptEncodings) q(coding string) float64 {
+	if q, ok := a[coding]; ok {
+		return q
+	}
+	if q, ok := a["*"]; ok {
+		return q
+	}
+	if coding == encodingIdentity {
+		return 0.001
+	}
+	return 0
+}
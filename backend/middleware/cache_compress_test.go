@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestCompressVariants(t *testing.T) {
+	body := []byte(`[` + strings.Repeat(`{"id":1,"title":"Foto van de route"},`, 100) + `{"id":2}]`)
+	entry := cachedResponse{Status: 200, Body: body}
+	compressVariants(&entry, 0)
+	if entry.Gzip == nil || entry.Brotli == nil {
+		t.Fatal("no compressed variants for a large body")
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(entry.Gzip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(gz); !bytes.Equal(got, body) {
+		t.Error("gzip variant does not decompress to the body")
+	}
+	if got, _ := io.ReadAll(brotli.NewReader(bytes.NewReader(entry.Brotli))); !bytes.Equal(got, body) {
+		t.Error("brotli variant does not decompress to the body")
+	}
+
+	small := cachedResponse{Body: []byte(`{"ok":true}`)}
+	compressVariants(&small, 0)
+	if small.Gzip != nil || small.Brotli != nil {
+		t.Error("small bodies should not be compressed")
+	}
+}
+
+func TestEncodeEntryIsBinary(t *testing.T) {
+	entry := cachedResponse{Status: 200, ContentType: "application/json", Body: []byte(`{"a":"b\nc"}`), StoredAt: 42}
+	entry.Gzip = []byte{0x1f, 0x8b, '\n', 0}
+	entry.Brotli = []byte{0xff, '\n'}
+
+	data := encodeEntry(entry)
+	raw := len(entry.Body) + len(entry.Gzip) + len(entry.Brotli)
+	if !bytes.HasSuffix(data, append(append(append([]byte{}, entry.Body...), entry.Gzip...), entry.Brotli...)) {
+		t.Fatalf("bodies are not stored raw: %q", data)
+	}
+
+	decoded, err := decodeEntry(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Status != 200 || decoded.ContentType != entry.ContentType || decoded.StoredAt != 42 ||
+		!bytes.Equal(decoded.Body, entry.Body) || !bytes.Equal(decoded.Gzip, entry.Gzip) || !bytes.Equal(decoded.Brotli, entry.Brotli) {
+		t.Fatalf("round trip changed the entry: %+v", decoded)
+	}
+	if len(data) > raw+200 {
+		t.Errorf("entry takes %d bytes for %d bytes of bodies", len(data), raw)
+	}
+
+	// Entries stored as JSON by older builds are a miss
+	if _, err := decodeEntry([]byte(`{"status":200,"body":"e30="}`)); err == nil {
+		t.Error("old JSON entry decoded")
+	}
+	if _, err := decodeEntry(data[:len(data)-1]); err == nil {
+		t.Error("truncated entry decoded")
+	}
+}
@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/jeffreasy/dkl25/backend/lib"
+)
+
+// CacheDependencyGraph records which cache groups must be purged when
+// another group is written, e.g. a photo write also purges "albums"
+type CacheDependencyGraph struct {
+	mu         sync.RWMutex
+	dependents map[string][]string
+}
+
+// NewCacheDependencyGraph creates an empty dependency graph
+func NewCacheDependencyGraph() *CacheDependencyGraph {
+	return &CacheDependencyGraph{dependents: make(map[string][]string)}
+}
+
+// Add records that writes to group also invalidate the dependent groups
+func (g *CacheDependencyGraph) Add(group string, dependents ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.dependents[group] = append(g.dependents[group], dependents...)
+}
+
+// Expand returns the groups followed by all groups that depend on them,
+// directly or transitively. Cycles are allowed.
+func (g *CacheDependencyGraph) Expand(groups ...string) []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var expanded []string
+	queue := append([]string{}, groups...)
+	for len(queue) > 0 {
+		group := queue[0]
+		queue = queue[1:]
+		if seen[group] {
+			continue
+		}
+		seen[group] = true
+		expanded = append(expanded, group)
+		queue = append(queue, g.dependents[group]...)
+	}
+	return expanded
+}
+
+// replace swaps in a new set of edges (used when policies reload)
+func (g *CacheDependencyGraph) replace(dependents map[string][]string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.dependents = dependents
+}
+
+// dependencyEdges turns the depends_on lists of policies into graph edges
+func dependencyEdges(policies []CachePolicy) map[string][]string {
+	edges := make(map[string][]string)
+	for _, policy := range policies {
+		for _, group := range policy.DependsOn {
+			edges[group] = append(edges[group], policy.Prefix)
+		}
+	}
+	for group := range edges {
+		sort.Strings(edges[group])
+	}
+	return edges
+}
+
+// InvalidationConfig configures CacheInvalidationWithConfig
+type InvalidationConfig struct {
+	Groups []string // cache groups (policy prefixes) written by the wrapped routes
+
+	// Routes are templates such as "/api/photos/{id}". When one matches the
+	// request, only the entries tagged with that resource and the group's list
+	// entries are purged instead of the whole group. This relies on the tags
+	// SmartCacheMiddleware adds; dependent groups are always purged entirely.
+	Routes []string
+
+	// Dependencies expands the written groups; nil uses the built-in policies
+	Dependencies *CacheDependencyGraph
+
+	// Warmer, when set, re-warms the purged groups in the background
+	Warmer *CacheWarmer
+}
+
+// CacheInvalidationMiddleware adds cache invalidation for write operations
+func CacheInvalidationMiddleware(patterns ...string) func(http.Handler) http.Handler {
+	return CacheInvalidationWithConfig(InvalidationConfig{Groups: patterns})
+}
+
+// CacheInvalidationWithConfig invalidates cache groups after successful writes.
+// The decision is made when the handler writes its status, so the purge
+// happens before the client sees the response and X-Cache-Invalidated is
+// still part of the headers.
+func CacheInvalidationWithConfig(config InvalidationConfig) func(http.Handler) http.Handler {
+	return HTTP(CacheInvalidationEngine(config))
+}
+
+// CacheInvalidationEngine is the transport-independent core of
+// CacheInvalidationWithConfig
+func CacheInvalidationEngine(config InvalidationConfig) Engine {
+	return func(x Exchange) {
+		if !isWriteMethod(x.Method()) {
+			x.Next()
+			return
+		}
+
+		x.Intercept(func(status int) {
+			if status >= 200 && status < 300 {
+				invalidateGroups(config, resourceID(config.Routes, x.Path()))
+				x.SetHeader("X-Cache-Invalidated", "true")
+			}
+		})
+	}
+}
+
+// isWriteMethod reports whether the method changes data
+func isWriteMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// resourceID returns the {id} of the first route template matching path
+func resourceID(routes []string, path string) string {
+	for _, route := range routes {
+		if params, ok := matchRoute(route, path); ok {
+			return params["id"]
+		}
+	}
+	return ""
+}
+
+// invalidateGroups purges the written groups and everything depending on them
+func invalidateGroups(config InvalidationConfig, id string) {
+	dependencies := config.Dependencies
+	if dependencies == nil {
+		dependencies = defaultCachePolicies.Dependencies()
+	}
+
+	var cdnKeys []string
+	purged := make(map[string]bool)
+	groups := dependencies.Expand(config.Groups...)
+
+	// A write to a single resource only touches that resource and the lists
+	if id != "" {
+		for _, group := range config.Groups {
+			for _, tag := range []string{resourceTag(group, id), listTag(group)} {
+				if err := lib.InvalidateTag(tag); err != nil {
+					fmt.Printf("Cache invalidation error for tag %s: %v\n", tag, err)
+				}
+				cdnKeys = append(cdnKeys, tag)
+			}
+			purged[group] = true
+		}
+	}
+
+	for _, group := range groups {
+		if purged[group] {
+			continue
+		}
+		if err := lib.InvalidateGroup(group); err != nil {
+			// Log error but don't fail the request
+			fmt.Printf("Cache invalidation error for group %s: %v\n", group, err)
+		}
+		cdnKeys = append(cdnKeys, group)
+	}
+
+	// Purge the same entries from the CDN (prefixes and tags are surrogate keys)
+	purgeCDN(cdnKeys)
+
+	if config.Warmer != nil {
+		config.Warmer.warmGroupsAsync(groups)
+	}
+}
+
+// PurgeGroup removes every cached entry of a group, locally and from the CDN
+func PurgeGroup(group string) error {
+	if err := lib.InvalidateGroup(group); err != nil {
+		return err
+	}
+	purgeCDN([]string{group})
+	return nil
+}
+
+// PurgeTag removes every cached entry with a tag, locally and from the CDN
+func PurgeTag(tag string) error {
+	if err := lib.InvalidateTag(tag); err != nil {
+		return err
+	}
+	purgeCDN([]string{tag})
+	return nil
+}
+
+// resourceTag is the tag of entries for a single resource, e.g. "photos:42"
+func resourceTag(group, id string) string {
+	return group + ":" + id
+}
+
+// listTag is the tag of entries that are not about a single resource
+func listTag(group string) string {
+	return group + ":list"
+}
+
+// resourceTags returns the resource tag for route params with an {id},
+// or the list tag otherwise
+func resourceTags(group string, params map[string]string) []string {
+	if id := params["id"]; id != "" {
+		return []string{resourceTag(group, id)}
+	}
+	return []string{listTag(group)}
+}
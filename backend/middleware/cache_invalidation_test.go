@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCacheDependencyGraphExpand(t *testing.T) {
+	graph := NewCacheDependencyGraph()
+	graph.Add("photos", "albums")
+	graph.Add("albums", "program", "photos")
+
+	if got, want := graph.Expand("photos"), []string{"photos", "albums", "program"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expand(photos) = %v, want %v", got, want)
+	}
+	if got, want := graph.Expand("social"), []string{"social"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expand(social) = %v, want %v", got, want)
+	}
+}
+
+func TestInvalidationOnlyAfterSuccessfulWrites(t *testing.T) {
+	setupRedis(t)
+	calls := make(map[string]int)
+	get := SmartCacheMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path]++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id":1}]`))
+	}))
+	paths := []string{"/api/photos", "/api/photos/42", "/api/photos/43", "/api/albums"}
+	fetch := func() {
+		for _, path := range paths {
+			get.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		}
+	}
+	fetch()
+
+	status := http.StatusInternalServerError
+	write := CacheInvalidationWithConfig(InvalidationConfig{
+		Groups: []string{"photos"},
+		Routes: []string{"/api/photos/{id}"},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	put := func() string {
+		rec := httptest.NewRecorder()
+		write.ServeHTTP(rec, httptest.NewRequest("PUT", "/api/photos/42", nil))
+		return rec.Header().Get("X-Cache-Invalidated")
+	}
+
+	// A failed write keeps everything cached
+	if invalidated := put(); invalidated != "" {
+		t.Errorf("failed write: X-Cache-Invalidated %q", invalidated)
+	}
+	fetch()
+	for _, path := range paths {
+		if calls[path] != 1 {
+			t.Errorf("%s recomputed %d times after a failed write", path, calls[path]-1)
+		}
+	}
+
+	// A successful one purges the photo, the photo lists and the albums
+	// depending on photos, but not other photos
+	status = http.StatusOK
+	if invalidated := put(); invalidated != "true" {
+		t.Errorf("successful write: X-Cache-Invalidated %q, want true", invalidated)
+	}
+	fetch()
+	for path, want := range map[string]int{"/api/photos": 2, "/api/photos/42": 2, "/api/photos/43": 1, "/api/albums": 2} {
+		if calls[path] != want {
+			t.Errorf("%s computed %d times, want %d", path, calls[path], want)
+		}
+	}
+}
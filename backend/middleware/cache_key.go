@@ -0,0 +1,161 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/jeffreasy/dkl25/backend/lib"
+)
+
+// DefaultQueryDenylist holds tracking parameters that never change a response.
+// A trailing "*" matches any parameter with that prefix.
+var DefaultQueryDenylist = []string{
+	"utm_*",
+	"fbclid",
+	"gclid",
+	"dclid",
+	"msclkid",
+	"igshid",
+	"mc_cid",
+	"mc_eid",
+	"_ga",
+	"ref",
+}
+
+// cacheKeyFor builds the cache key for a request from its path, its
+// normalized query and the vary headers of the config. Requests from an
+// origin in CORSOrigins also vary by it, as the stored CORS headers name it;
+// all other requests share one key.
+func cacheKeyFor(x Exchange, config CacheConfig) string {
+	parts := []string{x.Path(), NormalizeQuery(x.RawQuery(), config.QueryAllowlist, queryDenylist(config))}
+	parts = append(parts, varyKeyParts(x, config.Vary)...)
+	if origin := corsOrigin(x, config); origin != "" {
+		parts = append(parts, "origin="+origin)
+	}
+	return lib.VersionedCacheKey(config.Prefix, keyVersion(config), parts...)
+}
+
+// corsOrigin returns the request's Origin if it is in CORSOrigins, so the
+// number of keys per resource stays bounded by the configured origins
+func corsOrigin(x Exchange, config CacheConfig) string {
+	origin := x.Header("Origin")
+	if origin == "" {
+		return ""
+	}
+	for _, allowed := range config.CORSOrigins {
+		if strings.EqualFold(allowed, origin) {
+			return allowed
+		}
+	}
+	return ""
+}
+
+// queryDenylist returns the denied query parameters of a config
+func queryDenylist(config CacheConfig) []string {
+	if config.QueryDenylist == nil {
+		return DefaultQueryDenylist
+	}
+	return config.QueryDenylist
+}
+
+// hasUnlistedParam reports whether the query has a parameter that is neither
+// allowed nor denied. NormalizeQuery would drop it from the key although it
+// may change the response, so such requests bypass the cache.
+func hasUnlistedParam(rawQuery string, allow, deny []string) bool {
+	if rawQuery == "" || len(allow) == 0 {
+		return false
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// Malformed queries are kept in the key as they are
+		return false
+	}
+	for name := range query {
+		if !matchParam(allow, name) && !matchParam(deny, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyVersion returns the version the keys of a config are namespaced with
+func keyVersion(config CacheConfig) string {
+	if config.Version != "" {
+		return config.Version
+	}
+	return lib.CacheVersion()
+}
+
+// PurgeStaleCacheVersions deletes the entries each policy's group holds for
+// other versions, e.g. those a previous deploy wrote. Entries of other
+// versions are never served, so this only frees memory; run it in the
+// background at startup. A nil table uses the default policies.
+func PurgeStaleCacheVersions(policies *CachePolicyTable) error {
+	if policies == nil {
+		policies = defaultCachePolicies
+	}
+
+	var errs []error
+	for _, policy := range policies.Policies() {
+		config := policy.CacheConfig()
+		purged, err := lib.PurgeOtherVersions(policy.Prefix, keyVersion(config))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", policy.Prefix, err))
+		}
+		if purged > 0 {
+			log.Printf("Cache: purged %d entries of other versions from %s", purged, policy.Prefix)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// NormalizeQuery returns a canonical form of a raw query string for use in
+// cache keys. Parameters are sorted by name, denied parameters are removed
+// and, when allow is not empty, only allowed parameters are kept. The order
+// of repeated values is preserved because it can be meaningful.
+func NormalizeQuery(rawQuery string, allow, deny []string) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// Keep malformed queries distinct rather than collapsing them
+		return rawQuery
+	}
+
+	for name := range query {
+		if len(allow) > 0 && !matchParam(allow, name) {
+			query.Del(name)
+			continue
+		}
+		if matchParam(deny, name) {
+			query.Del(name)
+		}
+	}
+
+	// Encode sorts by parameter name
+	return query.Encode()
+}
+
+// matchParam reports whether name matches any pattern (case-insensitive,
+// a trailing "*" matches a prefix)
+func matchParam(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+			continue
+		}
+		if pattern == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffreasy/dkl25/backend/lib"
+)
+
+func TestNormalizeQuery(t *testing.T) {
+	allow := []string{"search", "year", "page", "sort*"}
+	cases := []struct {
+		name        string
+		query       string
+		allow, deny []string
+		want        string
+	}{
+		{"empty", "", nil, DefaultQueryDenylist, ""},
+		{"sorted", "year=2025&page=2", nil, DefaultQueryDenylist, "page=2&year=2025"},
+		{"tracking removed", "utm_source=x&utm_medium=y&fbclid=1&page=1", nil, DefaultQueryDenylist, "page=1"},
+		{"case-insensitive deny", "UTM_Source=x&page=1", nil, DefaultQueryDenylist, "page=1"},
+		{"repeated values keep order", "tag=b&tag=a", nil, DefaultQueryDenylist, "tag=b&tag=a"},
+		{"allowlist", "search=run&secret=1&page=1", allow, DefaultQueryDenylist, "page=1&search=run"},
+		{"allowlist prefix", "sortBy=date&sortOrder=asc", allow, DefaultQueryDenylist, "sortBy=date&sortOrder=asc"},
+		{"deny wins over allow", "search=x", allow, []string{"search"}, ""},
+		{"no deny list", "utm_source=x", nil, []string{}, "utm_source=x"},
+		{"escaping", "search=a+b&year=%32%30%32%35", allow, nil, "search=a+b&year=2025"},
+		{"malformed kept", "search=%zz", allow, nil, "search=%zz"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := NormalizeQuery(tc.query, tc.allow, tc.deny); got != tc.want {
+				t.Errorf("NormalizeQuery(%q) = %q, want %q", tc.query, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUnlistedQueryParamBypassesCache(t *testing.T) {
+	setupRedis(t)
+	handler := SmartCacheMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id":1}]`))
+	}))
+	xCache := func(path string) string {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Header().Get("X-Cache")
+	}
+
+	for _, tc := range []struct{ path, want string }{
+		{"/api/photos", "MISS"},
+		{"/api/photos?search=x", "MISS"},
+		{"/api/photos?search=x&utm_source=mail", "HIT"},
+		{"/api/albums?year=2025&album_id=3", "MISS"},
+		{"/api/photos?filter=private", "BYPASS"},
+		{"/api/photos?filter=private", "BYPASS"},
+	} {
+		if got := xCache(tc.path); got != tc.want {
+			t.Errorf("%s: X-Cache %q, want %s", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestCacheKeysAreVersioned(t *testing.T) {
+	mr := setupRedis(t)
+	lib.SetCacheVersion("2.1:0")
+	defer lib.SetCacheVersion("")
+
+	r := httptest.NewRequest("GET", "/api/photos?year=2024", nil)
+	if key := cacheKeyFor(&httpExchange{r: r}, CacheConfig{Prefix: "photos"}); key != "dkl:photos:v2.1_0:/api/photos:year=2024" {
+		t.Errorf("build version key %q", key)
+	}
+	if key := cacheKeyFor(&httpExchange{r: r}, CacheConfig{Prefix: "photos", Version: "3"}); key != "dkl:photos:v3:/api/photos:year=2024" {
+		t.Errorf("schema version key %q", key)
+	}
+
+	mr.Set("dkl:photos:v1:/api/photos:", "[]")
+	mr.Set("dkl:photos:/api/photos:", "[]")
+	mr.Set("dkl:photos:v2.1_0:/api/photos:", "[]")
+	mr.Set("dkl:albums:v1:/api/albums:", "[]")
+	mr.Set("dkl:ratelimit:/api/photos:1.1.1.1", "1")
+	table, err := NewCachePolicyTable([]CachePolicy{
+		{Name: "photos", Prefix: "photos", TTL: Duration(time.Minute), Routes: []RoutePattern{{Path: "/api/photos"}}},
+		{Name: "albums", Prefix: "albums", TTL: Duration(time.Minute), SchemaVersion: "1", Routes: []RoutePattern{{Path: "/api/albums"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PurgeStaleCacheVersions(table); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"dkl:albums:v1:/api/albums:", "dkl:photos:v2.1_0:/api/photos:", "dkl:ratelimit:/api/photos:1.1.1.1"}
+	if keys := mr.Keys(); strings.Join(keys, " ") != strings.Join(want, " ") {
+		t.Errorf("keys after the purge %v, want %v", keys, want)
+	}
+}
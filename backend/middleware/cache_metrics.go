@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// CacheCounters are the counters CacheMiddleware keeps per cache group.
+// They are per instance; add them up across instances for a global view.
+type CacheCounters struct {
+	Hits        int64 `json:"hits"`
+	Stale       int64 `json:"stale"`
+	Misses      int64 `json:"misses"`
+	Bypass      int64 `json:"bypass"`
+	Stores      int64 `json:"stores"`
+	StoreErrors int64 `json:"store_errors"`
+
+	// Negative (404/410/empty) entries are counted apart from regular ones
+	NegativeHits   int64 `json:"negative_hits"`
+	NegativeStores int64 `json:"negative_stores"`
+
+	// EarlyRefreshes counts entries recomputed by refresh-ahead
+	EarlyRefreshes int64 `json:"early_refreshes"`
+}
+
+// HitRatio returns the share of lookups answered from cache (stale and
+// negative hits included)
+func (c CacheCounters) HitRatio() float64 {
+	answered := c.Hits + c.Stale + c.NegativeHits
+	lookups := answered + c.Misses
+	if lookups == 0 {
+		return 0
+	}
+	return float64(answered) / float64(lookups)
+}
+
+type cacheMetrics struct {
+	hits        atomic.Int64
+	stale       atomic.Int64
+	misses      atomic.Int64
+	bypass      atomic.Int64
+	stores      atomic.Int64
+	storeErrors atomic.Int64
+
+	negativeHits   atomic.Int64
+	negativeStores atomic.Int64
+	earlyRefreshes atomic.Int64
+}
+
+var (
+	cacheMetricsMu sync.RWMutex
+	cacheMetricsBy = make(map[string]*cacheMetrics)
+)
+
+// metricsFor returns the counters of a cache group, creating them on first use
+func metricsFor(group string) *cacheMetrics {
+	cacheMetricsMu.RLock()
+	m, ok := cacheMetricsBy[group]
+	cacheMetricsMu.RUnlock()
+	if ok {
+		return m
+	}
+
+	cacheMetricsMu.Lock()
+	defer cacheMetricsMu.Unlock()
+	if m, ok = cacheMetricsBy[group]; !ok {
+		m = &cacheMetrics{}
+		cacheMetricsBy[group] = m
+	}
+	return m
+}
+
+// CacheStats returns a snapshot of the counters of every cache group
+func CacheStats() map[string]CacheCounters {
+	cacheMetricsMu.RLock()
+	defer cacheMetricsMu.RUnlock()
+
+	stats := make(map[string]CacheCounters, len(cacheMetricsBy))
+	for group, m := range cacheMetricsBy {
+		stats[group] = CacheCounters{
+			Hits:        m.hits.Load(),
+			Stale:       m.stale.Load(),
+			Misses:      m.misses.Load(),
+			Bypass:      m.bypass.Load(),
+			Stores:      m.stores.Load(),
+			StoreErrors: m.storeErrors.Load(),
+
+			NegativeHits:   m.negativeHits.Load(),
+			NegativeStores: m.negativeStores.Load(),
+			EarlyRefreshes: m.earlyRefreshes.Load(),
+		}
+	}
+	return stats
+}
+
+// ResetCacheStats sets all cache counters back to zero
+func ResetCacheStats() {
+	cacheMetricsMu.Lock()
+	defer cacheMetricsMu.Unlock()
+	cacheMetricsBy = make(map[string]*cacheMetrics)
+}
@@ -0,0 +1,531 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jeffreasy/dkl25/backend/config"
+)
+
+// Duration is a time.Duration that reads from strings like "30m" in policy files
+type Duration time.Duration
+
+// UnmarshalJSON parses a Go duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30m\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON writes the duration as a Go duration string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// RoutePattern matches request paths and methods.
+// Path segments in braces ("{id}") match a single segment and a trailing "*"
+// matches one or more remaining segments. Everything else must match exactly.
+type RoutePattern struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods,omitempty"`
+}
+
+// CacheBypass lists request properties that skip the cache entirely
+type CacheBypass struct {
+	Headers []string `json:"headers,omitempty"` // e.g. "Authorization"
+	Query   []string `json:"query,omitempty"`   // e.g. "nocache"
+	Cookies []string `json:"cookies,omitempty"` // e.g. "dkl_preview"
+}
+
+// CachePolicy describes how responses for a group of routes are cached
+type CachePolicy struct {
+	Name    string         `json:"name"`
+	Prefix  string         `json:"prefix"`
+	Routes  []RoutePattern `json:"routes"`
+	TTL     Duration       `json:"ttl"`
+	SoftTTL Duration       `json:"soft_ttl,omitempty"`
+	Vary    []string       `json:"vary,omitempty"`
+	Tags    []string       `json:"tags,omitempty"`
+	Bypass  CacheBypass    `json:"bypass,omitempty"`
+	Warm    []string       `json:"warm,omitempty"` // endpoints to request from WarmCache
+
+	// SchemaVersion pins the key namespace of the group. Without it the keys
+	// change with every deploy; with it they change only when it is bumped.
+	SchemaVersion string `json:"schema_version,omitempty"`
+
+	// DependsOn lists groups (prefixes) whose writes also invalidate this policy
+	DependsOn []string `json:"depends_on,omitempty"`
+
+	QueryAllow      []string `json:"query_allow,omitempty"` // only these params are part of the key
+	QueryDeny       []string `json:"query_deny,omitempty"`  // overrides DefaultQueryDenylist
+	CompressMinSize int      `json:"compress_min_size,omitempty"`
+	MaxBodySize     int      `json:"max_body_size,omitempty"`
+	NegativeTTL     Duration `json:"negative_ttl,omitempty"`      // caches 404/410 for this long
+	CacheEmptyLists bool     `json:"cache_empty_lists,omitempty"` // also caches [] for negative_ttl
+	RefreshAhead    bool     `json:"refresh_ahead,omitempty"`     // XFetch early recomputation
+	RefreshBeta     float64  `json:"refresh_beta,omitempty"`
+	TTLJitter       float64  `json:"ttl_jitter,omitempty"` // e.g. 0.1 shortens TTLs by up to 10%
+
+	// CORSOrigins are the origins whose CORS headers are cached per origin
+	CORSOrigins []string `json:"cors_origins,omitempty"`
+
+	// Schedule expires entries at programme boundaries instead of after TTL,
+	// which stays the upper bound. TTLFunc, set from Go, overrides both.
+	Schedule *ScheduleTTL                                `json:"schedule,omitempty"`
+	TTLFunc  func(x Exchange, body []byte) time.Duration `json:"-"`
+}
+
+// CacheConfig returns the CacheMiddleware configuration for this policy
+func (p *CachePolicy) CacheConfig() CacheConfig {
+	return CacheConfig{
+		TTL:     time.Duration(p.TTL),
+		SoftTTL: time.Duration(p.SoftTTL),
+		Prefix:  p.Prefix,
+		Vary:    p.Vary,
+		Tags:    p.Tags,
+		Bypass:  p.Bypass,
+		Version: p.SchemaVersion,
+
+		QueryAllowlist:  p.QueryAllow,
+		QueryDenylist:   p.QueryDeny,
+		CompressMinSize: p.CompressMinSize,
+		MaxBodySize:     p.MaxBodySize,
+		NegativeTTL:     time.Duration(p.NegativeTTL),
+		CacheEmptyLists: p.CacheEmptyLists,
+		RefreshAhead:    p.RefreshAhead,
+		RefreshBeta:     p.RefreshBeta,
+		TTLJitter:       p.TTLJitter,
+		CORSOrigins:     p.CORSOrigins,
+		TTLFunc:         p.ttlFunc(),
+	}
+}
+
+// ttlFunc returns the TTL function of the policy, or nil for a fixed TTL
+func (p *CachePolicy) ttlFunc() func(x Exchange, body []byte) time.Duration {
+	if p.TTLFunc != nil {
+		return p.TTLFunc
+	}
+	if p.Schedule != nil {
+		return p.Schedule.TTLFunc(time.Duration(p.TTL))
+	}
+	return nil
+}
+
+// Matches reports whether the policy applies to a request
+func (p *CachePolicy) Matches(method, path string) bool {
+	_, ok := p.RouteParams(method, path)
+	return ok
+}
+
+// RouteParams returns the "{name}" values of the first route that matches a request
+func (p *CachePolicy) RouteParams(method, path string) (map[string]string, bool) {
+	for _, route := range p.Routes {
+		if !methodAllowed(route.Methods, method) {
+			continue
+		}
+		if params, ok := matchRoute(route.Path, path); ok {
+			return params, true
+		}
+	}
+	return nil, false
+}
+
+// reservedPrefixes are the key groups lib keeps next to the response cache:
+// tag sets, rate limits and login lockouts. A policy using one would have
+// PurgeOtherVersions delete them as stale cache entries.
+var reservedPrefixes = []string{"tag", "ratelimit", "auth"}
+
+// Validate checks a single policy for mistakes that would silently disable caching
+func (p *CachePolicy) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("policy without name")
+	}
+	if p.Prefix == "" {
+		return fmt.Errorf("policy %s: prefix is required", p.Name)
+	}
+	if strings.ContainsAny(p.Prefix, ":*") {
+		return fmt.Errorf("policy %s: prefix must not contain ':' or '*'", p.Name)
+	}
+	if containsString(reservedPrefixes, p.Prefix) {
+		return fmt.Errorf("policy %s: prefix %s is reserved", p.Name, p.Prefix)
+	}
+	if strings.ContainsAny(p.SchemaVersion, ":*") {
+		return fmt.Errorf("policy %s: schema_version must not contain ':' or '*'", p.Name)
+	}
+	if p.TTL <= 0 {
+		return fmt.Errorf("policy %s: ttl must be positive", p.Name)
+	}
+	if p.SoftTTL < 0 || (p.SoftTTL != 0 && p.SoftTTL >= p.TTL) {
+		return fmt.Errorf("policy %s: soft_ttl must be shorter than ttl", p.Name)
+	}
+	if p.NegativeTTL < 0 || p.NegativeTTL > p.TTL {
+		return fmt.Errorf("policy %s: negative_ttl must be between 0 and ttl", p.Name)
+	}
+	if p.CacheEmptyLists && p.NegativeTTL == 0 {
+		return fmt.Errorf("policy %s: cache_empty_lists needs a negative_ttl", p.Name)
+	}
+	if p.RefreshBeta < 0 {
+		return fmt.Errorf("policy %s: refresh_beta must not be negative", p.Name)
+	}
+	if p.TTLJitter < 0 || p.TTLJitter >= 1 {
+		return fmt.Errorf("policy %s: ttl_jitter must be in [0, 1)", p.Name)
+	}
+	if p.Schedule != nil {
+		if err := p.Schedule.compile(); err != nil {
+			return fmt.Errorf("policy %s: %w", p.Name, err)
+		}
+	}
+	if len(p.Routes) == 0 {
+		return fmt.Errorf("policy %s: at least one route is required", p.Name)
+	}
+	for _, route := range p.Routes {
+		if err := validateRoutePattern(route.Path); err != nil {
+			return fmt.Errorf("policy %s: %w", p.Name, err)
+		}
+		for _, method := range route.Methods {
+			if method != http.MethodGet && method != http.MethodHead {
+				return fmt.Errorf("policy %s: method %s cannot be cached", p.Name, method)
+			}
+		}
+	}
+	for _, param := range append(append([]string{}, p.QueryAllow...), p.QueryDeny...) {
+		if param == "" || strings.Contains(strings.TrimSuffix(param, "*"), "*") {
+			return fmt.Errorf("policy %s: invalid query parameter pattern %q", p.Name, param)
+		}
+	}
+	for _, origin := range p.CORSOrigins {
+		if origin == "*" || !strings.Contains(origin, "://") {
+			return fmt.Errorf("policy %s: cors origin %q must be a scheme and host", p.Name, origin)
+		}
+	}
+	for _, endpoint := range p.Warm {
+		if !strings.HasPrefix(endpoint, "/") {
+			return fmt.Errorf("policy %s: warm endpoint %q must start with '/'", p.Name, endpoint)
+		}
+	}
+	return nil
+}
+
+// CachePolicyTable is a reloadable, ordered list of cache policies.
+// The first policy that matches a request wins.
+type CachePolicyTable struct {
+	mu           sync.RWMutex
+	policies     []CachePolicy
+	dependencies *CacheDependencyGraph
+	path         string
+	modTime      time.Time
+}
+
+// NewCachePolicyTable validates the policies and returns a table holding them
+func NewCachePolicyTable(policies []CachePolicy) (*CachePolicyTable, error) {
+	if err := validatePolicies(policies); err != nil {
+		return nil, err
+	}
+	return newCachePolicyTable(policies, "", time.Time{}), nil
+}
+
+// LoadCachePolicies reads and validates a JSON policy file
+func LoadCachePolicies(path string) (*CachePolicyTable, error) {
+	policies, modTime, err := readPolicyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newCachePolicyTable(policies, path, modTime), nil
+}
+
+func newCachePolicyTable(policies []CachePolicy, path string, modTime time.Time) *CachePolicyTable {
+	t := &CachePolicyTable{
+		policies:     policies,
+		dependencies: NewCacheDependencyGraph(),
+		path:         path,
+		modTime:      modTime,
+	}
+	t.dependencies.replace(dependencyEdges(policies))
+	return t
+}
+
+// DefaultCachePolicies returns the built-in policies used when no file is
+// configured: config/cache_policies.json, embedded at build time
+func DefaultCachePolicies() []CachePolicy {
+	policies, err := parsePolicies(config.CachePolicies)
+	if err != nil {
+		panic(fmt.Sprintf("embedded cache policies: %v", err))
+	}
+	return policies
+}
+
+// Match returns the first policy that applies to the request
+func (t *CachePolicyTable) Match(method, path string) (CachePolicy, map[string]string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, policy := range t.policies {
+		if params, ok := policy.RouteParams(method, path); ok {
+			return policy, params, true
+		}
+	}
+	return CachePolicy{}, nil, false
+}
+
+// Policies returns a copy of the current policies
+func (t *CachePolicyTable) Policies() []CachePolicy {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	policies := make([]CachePolicy, len(t.policies))
+	copy(policies, t.policies)
+	return policies
+}
+
+// WarmEndpoints returns the endpoints WarmCache should request, in policy
+// order. When groups are given only policies with those prefixes are used.
+func (t *CachePolicyTable) WarmEndpoints(groups ...string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var endpoints []string
+	seen := make(map[string]bool)
+	for _, policy := range t.policies {
+		if len(groups) > 0 && !containsString(groups, policy.Prefix) {
+			continue
+		}
+		for _, endpoint := range policy.Warm {
+			if !seen[endpoint] {
+				seen[endpoint] = true
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+	}
+	return endpoints
+}
+
+// Reload re-reads the policy file. The current policies stay active if the
+// new file fails validation.
+func (t *CachePolicyTable) Reload() error {
+	if t.path == "" {
+		return fmt.Errorf("policy table was not loaded from a file")
+	}
+
+	policies, modTime, err := readPolicyFile(t.path)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.policies = policies
+	t.modTime = modTime
+	t.mu.Unlock()
+
+	t.dependencies.replace(dependencyEdges(policies))
+	return nil
+}
+
+// Dependencies returns the dependency graph declared through depends_on.
+// The same graph is updated in place when the table reloads.
+func (t *CachePolicyTable) Dependencies() *CacheDependencyGraph {
+	return t.dependencies
+}
+
+// Watch reloads the policy file on SIGHUP or when its modification time
+// changes. It blocks until the context is cancelled.
+func (t *CachePolicyTable) Watch(ctx context.Context, pollInterval time.Duration) {
+	if t.path == "" {
+		return
+	}
+	if pollInterval <= 0 {
+		pollInterval = 5 * time.Second
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			t.reloadAndLog("SIGHUP")
+		case <-ticker.C:
+			info, err := os.Stat(t.path)
+			if err != nil {
+				continue
+			}
+			// The mtime is recorded before reloading, so a broken file is
+			// reported once rather than on every poll
+			t.mu.Lock()
+			changed := !info.ModTime().Equal(t.modTime)
+			t.modTime = info.ModTime()
+			t.mu.Unlock()
+			if changed {
+				t.reloadAndLog("file change")
+			}
+		}
+	}
+}
+
+func (t *CachePolicyTable) reloadAndLog(reason string) {
+	if err := t.Reload(); err != nil {
+		log.Printf("Cache policy reload (%s) failed, keeping current policies: %v", reason, err)
+		return
+	}
+	log.Printf("Cache policies reloaded from %s (%s)", t.path, reason)
+}
+
+// readPolicyFile reads, parses and validates a policy file
+func readPolicyFile(path string) ([]CachePolicy, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("cache policy file: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("cache policy file: %w", err)
+	}
+
+	policies, err := parsePolicies(data)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("cache policy file %s: %w", path, err)
+	}
+	return policies, info.ModTime(), nil
+}
+
+// parsePolicies parses and validates the JSON of a policy file
+func parsePolicies(data []byte) ([]CachePolicy, error) {
+	var file struct {
+		Policies []CachePolicy `json:"policies"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if err := validatePolicies(file.Policies); err != nil {
+		return nil, err
+	}
+	return file.Policies, nil
+}
+
+// validatePolicies validates each policy and checks names and prefixes are unique
+func validatePolicies(policies []CachePolicy) error {
+	names := make(map[string]bool)
+	prefixes := make(map[string]string)
+	for i := range policies {
+		policy := &policies[i]
+		for j := range policy.Routes {
+			if len(policy.Routes[j].Methods) == 0 {
+				policy.Routes[j].Methods = []string{http.MethodGet, http.MethodHead}
+			}
+		}
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		if names[policy.Name] {
+			return fmt.Errorf("duplicate policy name %s", policy.Name)
+		}
+		names[policy.Name] = true
+		if other, exists := prefixes[policy.Prefix]; exists {
+			return fmt.Errorf("policies %s and %s share prefix %s", other, policy.Name, policy.Prefix)
+		}
+		prefixes[policy.Prefix] = policy.Name
+	}
+	for _, policy := range policies {
+		for _, group := range policy.DependsOn {
+			if _, exists := prefixes[group]; !exists {
+				return fmt.Errorf("policy %s depends on unknown group %s", policy.Name, group)
+			}
+		}
+	}
+	return nil
+}
+
+// validateRoutePattern checks a route pattern is well formed
+func validateRoutePattern(pattern string) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("route %q must start with '/'", pattern)
+	}
+	segments := splitPath(pattern)
+	for i, segment := range segments {
+		if segment == "*" && i != len(segments)-1 {
+			return fmt.Errorf("route %q: '*' is only allowed as the last segment", pattern)
+		}
+		if strings.HasPrefix(segment, "{") != strings.HasSuffix(segment, "}") {
+			return fmt.Errorf("route %q: unbalanced braces in %q", pattern, segment)
+		}
+	}
+	return nil
+}
+
+// matchRoute matches a path against a route pattern segment by segment and
+// returns the values of its "{name}" segments
+func matchRoute(pattern, path string) (map[string]string, bool) {
+	patternSegments := splitPath(pattern)
+	pathSegments := splitPath(path)
+
+	var params map[string]string
+	for i, segment := range patternSegments {
+		if segment == "*" {
+			return params, len(pathSegments) > i
+		}
+		if i >= len(pathSegments) {
+			return nil, false
+		}
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[segment[1:len(segment)-1]] = pathSegments[i]
+			continue
+		}
+		if segment != pathSegments[i] {
+			return nil, false
+		}
+	}
+	return params, len(patternSegments) == len(pathSegments)
+}
+
+// containsString reports whether value is in values
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// splitPath splits a path into its non-empty segments
+func splitPath(path string) []string {
+	return strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+}
+
+// methodAllowed reports whether method is in the list (an empty list allows GET and HEAD)
+func methodAllowed(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return method == http.MethodGet || method == http.MethodHead
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffreasy/dkl25/backend/config"
+)
+
+func TestDefaultCachePoliciesMatchConfigFile(t *testing.T) {
+	file, err := LoadCachePolicies("../config/cache_policies.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := json.Marshal(file.Policies())
+	got, _ := json.Marshal(DefaultCachePolicies())
+	if string(got) != string(want) {
+		t.Fatalf("defaults differ from config/cache_policies.json:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestDefaultCachePoliciesBypassAuthorization(t *testing.T) {
+	table, err := NewCachePolicyTable(DefaultCachePolicies())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/api/photos", "/api/albums/1"} {
+		policy, _, ok := table.Match("GET", path)
+		if !ok {
+			t.Fatalf("%s: no policy", path)
+		}
+		if !containsString(policy.Bypass.Headers, "Authorization") {
+			t.Errorf("%s: policy %s does not bypass authenticated requests", path, policy.Name)
+		}
+	}
+}
+
+func TestWatchReportsBrokenFileOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache_policies.json")
+	if err := os.WriteFile(path, config.CachePolicies, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	table, err := LoadCachePolicies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	os.WriteFile(path, []byte(`{"policies": [`), 0o644)
+	changed := time.Now().Add(time.Minute)
+	os.Chtimes(path, changed, changed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		table.Watch(ctx, 5*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	if failures := strings.Count(logs.String(), "reload (file change) failed"); failures != 1 {
+		t.Errorf("broken file reported %d times, want once:\n%s", failures, logs.String())
+	}
+	if len(table.Policies()) == 0 {
+		t.Error("broken file replaced the policies")
+	}
+}
+
+func TestCachePolicyRejectsReservedPrefixes(t *testing.T) {
+	for _, prefix := range []string{"tag", "ratelimit", "auth"} {
+		policy := CachePolicy{Name: "p", Prefix: prefix, TTL: Duration(time.Minute), Routes: []RoutePattern{{Path: "/api/photos"}}}
+		if err := policy.Validate(); err == nil || !strings.Contains(err.Error(), "reserved") {
+			t.Errorf("prefix %s: %v", prefix, err)
+		}
+	}
+	policy := CachePolicy{Name: "p", Prefix: "tags", TTL: Duration(time.Minute), Routes: []RoutePattern{{Path: "/api/tags"}}}
+	if err := policy.Validate(); err != nil {
+		t.Errorf("prefix tags: %v", err)
+	}
+}
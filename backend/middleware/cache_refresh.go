@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// DefaultRefreshBeta is the XFetch beta used when RefreshBeta is 0.
+// Higher values refresh earlier; 1.0 is the value recommended by the paper.
+const DefaultRefreshBeta = 1.0
+
+// shouldRefreshEarly implements XFetch (Vattani et al., "Optimal Probabilistic
+// Cache Stampede Prevention"): an entry is recomputed early with a probability
+// that grows as it nears expiry and with how long it took to compute, so one
+// request refreshes a hot key before it expires instead of all at once after.
+func shouldRefreshEarly(entry cachedResponse, beta float64, now time.Time) bool {
+	if entry.ComputeMS <= 0 || entry.ExpiresAtMS == 0 {
+		return false
+	}
+	if beta <= 0 {
+		beta = DefaultRefreshBeta
+	}
+
+	// -ln(U) for U in (0,1] is exponentially distributed with mean 1
+	gap := -float64(entry.ComputeMS) * beta * math.Log(1-rand.Float64())
+	return float64(now.UnixMilli())+gap >= float64(entry.ExpiresAtMS)
+}
+
+// jitterTTL shortens ttl by a random share of up to fraction (0.1 = 10%), so
+// entries written together (e.g. by a CacheWarmer) do not expire together.
+// It never returns more than ttl.
+func jitterTTL(ttl time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 || ttl <= 0 {
+		return ttl
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	return ttl - time.Duration(rand.Float64()*fraction*float64(ttl))
+}
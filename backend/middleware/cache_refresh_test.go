@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShouldRefreshEarly(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name  string
+		entry cachedResponse
+		want  bool
+	}{
+		{"far from expiry", cachedResponse{ComputeMS: 5, ExpiresAtMS: now.Add(time.Hour).UnixMilli()}, false},
+		{"expired", cachedResponse{ComputeMS: 5, ExpiresAtMS: now.UnixMilli()}, true},
+		{"no compute time", cachedResponse{ExpiresAtMS: now.UnixMilli()}, false},
+		{"no expiry", cachedResponse{ComputeMS: 5}, false},
+	}
+	for _, tc := range cases {
+		// XFetch is random; these cases are decided whatever it draws
+		for i := 0; i < 100; i++ {
+			if got := shouldRefreshEarly(tc.entry, 0, now); got != tc.want {
+				t.Fatalf("%s: %v, want %v", tc.name, got, tc.want)
+			}
+		}
+	}
+
+	// Slow handlers refresh earlier: with a minute to go a 30s handler
+	// refreshes with probability e^-2 (13.5%), a 1ms one practically never
+	expires := now.Add(time.Minute).UnixMilli()
+	slow, fast := 0, 0
+	for i := 0; i < 1000; i++ {
+		if shouldRefreshEarly(cachedResponse{ComputeMS: 30000, ExpiresAtMS: expires}, 1, now) {
+			slow++
+		}
+		if shouldRefreshEarly(cachedResponse{ComputeMS: 1, ExpiresAtMS: expires}, 1, now) {
+			fast++
+		}
+	}
+	if slow < 50 || slow > 300 || fast != 0 {
+		t.Errorf("refreshed %d of 1000 slow and %d fast entries", slow, fast)
+	}
+}
+
+func TestJitterTTL(t *testing.T) {
+	if got := jitterTTL(time.Hour, 0); got != time.Hour {
+		t.Errorf("no jitter: %s", got)
+	}
+	if got := jitterTTL(0, 0.5); got != 0 {
+		t.Errorf("zero TTL: %s", got)
+	}
+
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 1000; i++ {
+		got := jitterTTL(time.Hour, 0.1)
+		if got > time.Hour || got < 54*time.Minute {
+			t.Fatalf("jitterTTL(1h, 0.1) = %s, want between 54m and 1h", got)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 100 {
+		t.Errorf("only %d distinct TTLs in 1000", len(seen))
+	}
+}
+
+func TestRefreshAheadRecomputesBeforeExpiry(t *testing.T) {
+	setupRedis(t)
+	ResetCacheStats()
+	calls := 0
+	handler := CacheMiddleware(CacheConfig{TTL: 50 * time.Millisecond, Prefix: "refresh", RefreshAhead: true})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`[1]`))
+	}))
+	get := func() string {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/photos", nil))
+		return rec.Header().Get("X-Cache")
+	}
+
+	get()
+	if status := get(); status != "HIT" {
+		t.Fatalf("fresh entry: X-Cache %q, want HIT", status)
+	}
+
+	// The entry is still in Redis (miniredis time stands still) but past its
+	// expiry, where XFetch always refreshes
+	time.Sleep(60 * time.Millisecond)
+	if status := get(); status != "MISS" || calls != 2 {
+		t.Errorf("expiring entry: X-Cache %q after %d calls, want a recompute", status, calls)
+	}
+	if refreshes := CacheStats()["refresh"].EarlyRefreshes; refreshes != 1 {
+		t.Errorf("%d early refreshes counted, want 1", refreshes)
+	}
+}
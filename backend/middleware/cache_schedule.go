@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	// Embedded zone database, so Europe/Amsterdam loads in slim containers
+	_ "time/tzdata"
+)
+
+// DefaultScheduleLocation is the time zone programme times are written in
+const DefaultScheduleLocation = "Europe/Amsterdam"
+
+// scheduleClock finds "10:30" or "10.30" in a programme time such as "10:30 - 11:00 uur"
+var scheduleClock = regexp.MustCompile(`\b([01]?\d|2[0-3])[:.]([0-5]\d)\b`)
+
+// ScheduleTTL expires cached programme responses at the next programme item
+// boundary, and at midnight at the latest, so visitors never see an outdated
+// "now on stage". During the event window the TTL is capped further.
+type ScheduleTTL struct {
+	Location  string `json:"location,omitempty"`   // IANA zone; default DefaultScheduleLocation
+	TimeField string `json:"time_field,omitempty"` // item field holding the time; default "time"
+
+	// EventStart and EventEnd (YYYY-MM-DD, inclusive) mark the event window
+	// in which TTLs are capped at EventMaxTTL
+	EventStart  string   `json:"event_start,omitempty"`
+	EventEnd    string   `json:"event_end,omitempty"`
+	EventMaxTTL Duration `json:"event_max_ttl,omitempty"`
+
+	// Set by compile
+	loc        *time.Location
+	eventFrom  time.Time
+	eventUntil time.Time
+}
+
+// compile validates the schedule and resolves its location and event window
+func (s *ScheduleTTL) compile() error {
+	name := s.Location
+	if name == "" {
+		name = DefaultScheduleLocation
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return fmt.Errorf("schedule location: %w", err)
+	}
+
+	var from, until time.Time
+	if s.EventStart != "" || s.EventEnd != "" {
+		if s.EventStart == "" || s.EventEnd == "" {
+			return fmt.Errorf("schedule needs both event_start and event_end")
+		}
+		if from, err = time.ParseInLocation("2006-01-02", s.EventStart, loc); err != nil {
+			return fmt.Errorf("schedule event_start: %w", err)
+		}
+		end, err := time.ParseInLocation("2006-01-02", s.EventEnd, loc)
+		if err != nil {
+			return fmt.Errorf("schedule event_end: %w", err)
+		}
+		if end.Before(from) {
+			return fmt.Errorf("schedule event_end is before event_start")
+		}
+		if s.EventMaxTTL <= 0 {
+			return fmt.Errorf("schedule event window needs a positive event_max_ttl")
+		}
+		until = end.AddDate(0, 0, 1)
+	}
+
+	s.loc, s.eventFrom, s.eventUntil = loc, from, until
+	return nil
+}
+
+// TTLFunc returns a CacheConfig.TTLFunc that never exceeds maxTTL
+func (s *ScheduleTTL) TTLFunc(maxTTL time.Duration) func(x Exchange, body []byte) time.Duration {
+	return func(x Exchange, body []byte) time.Duration {
+		return s.ttlAt(time.Now(), body, maxTTL)
+	}
+}
+
+// ttlAt returns how long a programme response produced at now stays valid
+func (s *ScheduleTTL) ttlAt(now time.Time, body []byte, maxTTL time.Duration) time.Duration {
+	if s.loc == nil {
+		return maxTTL
+	}
+	now = now.In(s.loc)
+
+	ttl := maxTTL
+	if !s.eventFrom.IsZero() && !now.Before(s.eventFrom) && now.Before(s.eventUntil) {
+		ttl = shorterTTL(ttl, time.Duration(s.EventMaxTTL))
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, s.loc)
+	next := midnight
+	for _, boundary := range s.boundaries(now, body) {
+		if boundary.After(now) && boundary.Before(next) {
+			next = boundary
+		}
+	}
+	ttl = shorterTTL(ttl, next.Sub(now))
+
+	// Never store for less than a second
+	if ttl < time.Second {
+		return time.Second
+	}
+	return ttl
+}
+
+// boundaries returns today's start and end times of the programme items in
+// body, which is a single item or a list of items
+func (s *ScheduleTTL) boundaries(now time.Time, body []byte) []time.Time {
+	var items []map[string]any
+	if err := json.Unmarshal(body, &items); err != nil {
+		var item map[string]any
+		if json.Unmarshal(body, &item) != nil {
+			return nil
+		}
+		items = []map[string]any{item}
+	}
+
+	field := s.TimeField
+	if field == "" {
+		field = "time"
+	}
+
+	var times []time.Time
+	for _, item := range items {
+		value, _ := item[field].(string)
+		for _, match := range scheduleClock.FindAllStringSubmatch(value, -1) {
+			hour, _ := strconv.Atoi(match[1])
+			minute, _ := strconv.Atoi(match[2])
+			times = append(times, time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, s.loc))
+		}
+	}
+	return times
+}
+
+// shorterTTL returns the shorter of two durations
+func shorterTTL(a, b time.Duration) time.Duration {
+	if b < a {
+		return b
+	}
+	return a
+}
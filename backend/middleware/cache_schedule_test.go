@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleTTL(t *testing.T) {
+	schedule := &ScheduleTTL{EventStart: "2026-05-16", EventEnd: "2026-05-16", EventMaxTTL: Duration(5 * time.Minute)}
+	if err := schedule.compile(); err != nil {
+		t.Fatal(err)
+	}
+	amsterdam, _ := time.LoadLocation("Europe/Amsterdam")
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, amsterdam)
+	}
+	programme := []byte(`[{"time": "10:00 - 10.30 uur"}, {"time": "13:15"}, {"time": "03:00"}]`)
+
+	cases := []struct {
+		name   string
+		now    time.Time
+		body   []byte
+		maxTTL time.Duration
+		want   time.Duration
+	}{
+		{"until the next item", at(time.May, 15, 10, 10), programme, 2 * time.Hour, 20 * time.Minute},
+		{"max TTL before the next item", at(time.May, 15, 10, 30), programme, 2 * time.Hour, 2 * time.Hour},
+		{"no items left today", at(time.May, 15, 14, 0), programme, 2 * time.Hour, 2 * time.Hour},
+		{"midnight", at(time.May, 15, 23, 0), programme, 2 * time.Hour, time.Hour},
+		{"at least a second", at(time.May, 15, 23, 59).Add(59*time.Second + 500*time.Millisecond), nil, 2 * time.Hour, time.Second},
+		{"single item", at(time.May, 15, 11, 0), []byte(`{"time": "11:02"}`), 2 * time.Hour, 2 * time.Minute},
+		{"not a programme", at(time.May, 15, 11, 0), []byte(`"soon"`), 2 * time.Hour, 2 * time.Hour},
+		{"UTC input", time.Date(2026, time.May, 15, 8, 10, 0, 0, time.UTC), programme, 2 * time.Hour, 20 * time.Minute},
+
+		{"event day", at(time.May, 16, 11, 0), programme, 2 * time.Hour, 5 * time.Minute},
+		{"event day, next item sooner", at(time.May, 16, 13, 12), programme, 2 * time.Hour, 3 * time.Minute},
+		{"event day, midnight sooner", at(time.May, 16, 23, 58), programme, 2 * time.Hour, 2 * time.Minute},
+		{"event day starts at local midnight", time.Date(2026, time.May, 15, 22, 0, 0, 0, time.UTC), programme, 2 * time.Hour, 5 * time.Minute},
+		{"day after the event", at(time.May, 17, 0, 0), programme, 2 * time.Hour, 2 * time.Hour},
+
+		// Summer time ends on 2026-10-25: 03:00 CEST becomes 02:00 CET, so
+		// that day has 25 hours
+		{"day before DST ends", at(time.October, 24, 12, 0), nil, 48 * time.Hour, 12 * time.Hour},
+		{"evening before DST ends", at(time.October, 24, 23, 0), nil, 48 * time.Hour, time.Hour},
+		{"DST day, CEST", time.Date(2026, time.October, 24, 22, 30, 0, 0, time.UTC), nil, 48 * time.Hour, 24*time.Hour + 30*time.Minute},
+		{"DST day, item after the change", time.Date(2026, time.October, 24, 23, 0, 0, 0, time.UTC), programme, 48 * time.Hour, 3 * time.Hour},
+		{"DST day, CET", at(time.October, 25, 12, 0), nil, 48 * time.Hour, 12 * time.Hour},
+		{"day after DST ends", at(time.October, 26, 12, 0), nil, 48 * time.Hour, 12 * time.Hour},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := schedule.ttlAt(tc.now, tc.body, tc.maxTTL); got != tc.want {
+				t.Errorf("ttlAt(%s) = %s, want %s", tc.now.In(amsterdam), got, tc.want)
+			}
+		})
+	}
+}
+
+func TestScheduleTTLRejectsInvalidWindows(t *testing.T) {
+	for _, schedule := range []ScheduleTTL{
+		{Location: "Mars/Olympus"},
+		{EventStart: "2026-05-16"},
+		{EventStart: "16-05-2026", EventEnd: "2026-05-16", EventMaxTTL: Duration(time.Minute)},
+		{EventStart: "2026-05-16", EventEnd: "2026-05-15", EventMaxTTL: Duration(time.Minute)},
+		{EventStart: "2026-05-16", EventEnd: "2026-05-16"},
+	} {
+		if err := schedule.compile(); err == nil {
+			t.Errorf("%+v: no error", schedule)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheHitReplaysHeaders(t *testing.T) {
+	mr := setupRedis(t)
+	calls := 0
+	handler := CacheMiddleware(CacheConfig{
+		TTL:         time.Minute,
+		Prefix:      "test",
+		CORSOrigins: []string{"https://www.dekoninklijkeloop.nl"},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if origin := r.Header.Get("Origin"); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 19 Oct 2026 10:00:00 GMT")
+		w.Header().Set("X-Request-Only", "1")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id":1}]`))
+	}))
+	get := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/photos", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	get("https://www.dekoninklijkeloop.nl")
+	rec := get("https://www.dekoninklijkeloop.nl")
+	if rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("X-Cache = %q, want HIT", rec.Header().Get("X-Cache"))
+	}
+	for name, want := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://www.dekoninklijkeloop.nl",
+		"Access-Control-Allow-Credentials": "true",
+		"Cache-Control":                    "public, max-age=60",
+		"ETag":                             `"v1"`,
+		"Last-Modified":                    "Mon, 19 Oct 2026 10:00:00 GMT",
+		"X-Request-Only":                   "",
+	} {
+		if got := rec.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if vary := rec.Header().Values("Vary"); len(vary) == 0 || vary[0] != "Origin" {
+		t.Errorf("Vary = %q, want Origin", vary)
+	}
+
+	// Other origins share the entry of same-origin requests, which is stored
+	// without the CORS headers the handler reflected
+	if rec := get("https://evil.example"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("other origin: X-Cache %q, want MISS", rec.Header().Get("X-Cache"))
+	}
+	for _, origin := range []string{"", "https://evil.example", "https://random.example"} {
+		if rec := get(origin); rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("origin %q: X-Cache %q, Access-Control-Allow-Origin %q", origin, rec.Header().Get("X-Cache"), rec.Header().Get("Access-Control-Allow-Origin"))
+		}
+	}
+	if calls != 2 {
+		t.Errorf("handler ran %d times, want 2", calls)
+	}
+	if keys := mr.Keys(); len(keys) != 2 {
+		t.Errorf("stored %v, want one entry per configured origin and one without", keys)
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	mr := setupRedis(t)
+	calls := 0
+	handler := CacheMiddleware(CacheConfig{
+		TTL:             time.Hour,
+		Prefix:          "test",
+		NegativeTTL:     2 * time.Minute,
+		CacheEmptyLists: true,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path == "/empty" {
+			w.Write([]byte(" [ ] "))
+			return
+		}
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	for _, path := range []string{"/missing", "/empty"} {
+		get(path)
+		if rec := get(path); rec.Header().Get("X-Cache") != "HIT" || rec.Code != map[string]int{"/missing": 404, "/empty": 200}[path] {
+			t.Errorf("%s: %d X-Cache %q, want a HIT", path, rec.Code, rec.Header().Get("X-Cache"))
+		}
+	}
+	if calls != 2 {
+		t.Errorf("handler ran %d times, want 2", calls)
+	}
+
+	// Negative entries expire after NegativeTTL, not TTL
+	mr.FastForward(2*time.Minute + time.Second)
+	if rec := get("/missing"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("after NegativeTTL: X-Cache %q, want MISS", rec.Header().Get("X-Cache"))
+	}
+}
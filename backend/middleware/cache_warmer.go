@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultWarmConcurrency is the number of endpoints warmed in parallel
+const DefaultWarmConcurrency = 4
+
+// WarmResult is the outcome of warming one endpoint
+type WarmResult struct {
+	Endpoint  string `json:"endpoint"`
+	Status    int    `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Cache     string `json:"cache"` // X-Cache of the response: MISS, HIT, ...
+	Error     string `json:"error,omitempty"`
+}
+
+// OK reports whether the endpoint answered with a 2xx status
+func (r WarmResult) OK() bool {
+	return r.Error == "" && r.Status >= 200 && r.Status < 300
+}
+
+// WarmReport aggregates the results of one warming run
+type WarmReport struct {
+	StartedAt  time.Time    `json:"started_at"`
+	DurationMS int64        `json:"duration_ms"`
+	Succeeded  int          `json:"succeeded"`
+	Failed     int          `json:"failed"`
+	Results    []WarmResult `json:"results"`
+}
+
+// Err returns an error listing the failed endpoints, or nil
+func (r WarmReport) Err() error {
+	var errs []error
+	for _, result := range r.Results {
+		if result.OK() {
+			continue
+		}
+		if result.Error != "" {
+			errs = append(errs, fmt.Errorf("%s: %s", result.Endpoint, result.Error))
+		} else {
+			errs = append(errs, fmt.Errorf("%s: status %d", result.Endpoint, result.Status))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CacheWarmer requests endpoints so their responses are cached before
+// visitors ask for them
+type CacheWarmer struct {
+	BaseURL     string
+	Client      *http.Client
+	Concurrency int               // parallel requests; 0 uses DefaultWarmConcurrency
+	Policies    *CachePolicyTable // source of warm endpoints; nil uses the defaults
+}
+
+// Warm requests every endpoint, continuing past failures
+func (cw *CacheWarmer) Warm(ctx context.Context, endpoints []string) WarmReport {
+	report := WarmReport{StartedAt: time.Now(), Results: make([]WarmResult, len(endpoints))}
+
+	concurrency := cw.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultWarmConcurrency
+	}
+	client := cw.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func(i int, endpoint string) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+				report.Results[i] = cw.warmOne(ctx, client, endpoint)
+			case <-ctx.Done():
+				report.Results[i] = WarmResult{Endpoint: endpoint, Error: ctx.Err().Error()}
+			}
+		}(i, endpoint)
+	}
+	wg.Wait()
+
+	for _, result := range report.Results {
+		if result.OK() {
+			report.Succeeded++
+		} else {
+			report.Failed++
+		}
+	}
+	report.DurationMS = time.Since(report.StartedAt).Milliseconds()
+	return report
+}
+
+// WarmAll warms the endpoints of every policy
+func (cw *CacheWarmer) WarmAll(ctx context.Context) WarmReport {
+	return cw.Warm(ctx, cw.policies().WarmEndpoints())
+}
+
+// WarmGroups warms the endpoints of the policies with the given prefixes,
+// e.g. the groups an invalidation just purged
+func (cw *CacheWarmer) WarmGroups(ctx context.Context, groups ...string) WarmReport {
+	return cw.Warm(ctx, cw.policies().WarmEndpoints(groups...))
+}
+
+// Run warms all endpoints now and then every interval until ctx is cancelled.
+// An interval <= 0, e.g. an unset setting, warms once and returns.
+func (cw *CacheWarmer) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		logWarmReport("once", cw.WarmAll(ctx))
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		logWarmReport("scheduled", cw.WarmAll(ctx))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// warmGroupsAsync re-warms purged groups in the background
+func (cw *CacheWarmer) warmGroupsAsync(groups []string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+		logWarmReport("after invalidation", cw.WarmGroups(ctx, groups...))
+	}()
+}
+
+// warmOne requests a single endpoint and records the result
+func (cw *CacheWarmer) warmOne(ctx context.Context, client *http.Client, endpoint string) WarmResult {
+	result := WarmResult{Endpoint: endpoint}
+	start := time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cw.BaseURL+endpoint, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		result.LatencyMS = time.Since(start).Milliseconds()
+		return result
+	}
+	// Read and discard body to trigger caching, then release the connection
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	result.Status = resp.StatusCode
+	result.Cache = resp.Header.Get("X-Cache")
+	result.LatencyMS = time.Since(start).Milliseconds()
+	return result
+}
+
+func (cw *CacheWarmer) policies() *CachePolicyTable {
+	if cw.Policies == nil {
+		return defaultCachePolicies
+	}
+	return cw.Policies
+}
+
+// logWarmReport logs a one-line summary and every failed endpoint
+func logWarmReport(reason string, report WarmReport) {
+	log.Printf("Cache warm (%s): %d ok, %d failed in %dms",
+		reason, report.Succeeded, report.Failed, report.DurationMS)
+	if err := report.Err(); err != nil {
+		log.Printf("Cache warm failures: %v", err)
+	}
+}
+
+// WarmCache pre-populates cache with common requests.
+// Use CachePolicyTable.WarmEndpoints to warm the endpoints of the active
+// policies, or a CacheWarmer for concurrency, scheduling and reports.
+func WarmCache(baseURL string, endpoints []string, client *http.Client) error {
+	warmer := &CacheWarmer{BaseURL: baseURL, Client: client}
+	return warmer.Warm(context.Background(), endpoints).Err()
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheWarmerRunWithoutInterval(t *testing.T) {
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer server.Close()
+
+	policies, err := NewCachePolicyTable(DefaultCachePolicies())
+	if err != nil {
+		t.Fatal(err)
+	}
+	warmer := &CacheWarmer{BaseURL: server.URL, Policies: policies}
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		requests.Store(0)
+		done := make(chan struct{})
+		go func() {
+			warmer.Run(context.Background(), interval)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Run(%s) did not return", interval)
+		}
+		if got, want := requests.Load(), int64(len(policies.WarmEndpoints())); got != want {
+			t.Errorf("Run(%s) warmed %d endpoints, want %d", interval, got, want)
+		}
+	}
+}
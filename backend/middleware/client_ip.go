@@ -0,0 +1,220 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// DefaultTrustedProxies are the loopback and private ranges. Render's load
+// balancers and the dkl-edge proxy reach the API from these; add CDN ranges
+// with NewClientIPResolver.
+var DefaultTrustedProxies = []string{
+	"127.0.0.0/8", "::1/128",
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+}
+
+// ForwardingHeader is the header a ClientIPResolver reads the client from
+type ForwardingHeader string
+
+const (
+	// XForwardedFor is the de facto standard, set by Render and most proxies
+	XForwardedFor ForwardingHeader = "X-Forwarded-For"
+	// Forwarded is RFC 7239; only use it when the trusted proxies set it
+	Forwarded ForwardingHeader = "Forwarded"
+	// XRealIP is set by nginx setups with a single proxy
+	XRealIP ForwardingHeader = "X-Real-IP"
+)
+
+// ClientIPResolver finds the client address of a request. Forwarding headers
+// are only believed when they were added by a trusted proxy, so clients cannot
+// pick their own rate limit key by sending X-Forwarded-For. Only one header is
+// read: the one the trusted proxies set. Any other can still come from the
+// client, passed on untouched by the proxy.
+type ClientIPResolver struct {
+	trusted []netip.Prefix
+	header  ForwardingHeader
+
+	// ipv6Prefix aggregates IPv6 clients to this prefix length, so a host
+	// cannot rotate through the addresses of its /64; 0 keeps the address
+	ipv6Prefix int
+}
+
+// defaultResolver is used by the rate limiters, see SetClientIPResolver
+var defaultResolver atomic.Pointer[ClientIPResolver]
+
+func init() {
+	resolver, err := NewClientIPResolver(DefaultTrustedProxies, 0)
+	if err != nil {
+		panic(err)
+	}
+	defaultResolver.Store(resolver)
+}
+
+// NewClientIPResolver creates a resolver trusting the given CIDRs or single
+// addresses. ipv6Prefix (e.g. 64) aggregates IPv6 clients; 0 disables it. The
+// client is read from X-Forwarded-For unless another header is passed.
+func NewClientIPResolver(trustedProxies []string, ipv6Prefix int, header ...ForwardingHeader) (*ClientIPResolver, error) {
+	if ipv6Prefix < 0 || ipv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid IPv6 prefix length %d", ipv6Prefix)
+	}
+
+	resolver := &ClientIPResolver{ipv6Prefix: ipv6Prefix, header: XForwardedFor}
+	if len(header) > 0 {
+		switch header[0] {
+		case XForwardedFor, Forwarded, XRealIP:
+			resolver.header = header[0]
+		default:
+			return nil, fmt.Errorf("unsupported forwarding header %q", header[0])
+		}
+	}
+	for _, cidr := range trustedProxies {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+			}
+			resolver.trusted = append(resolver.trusted, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+		}
+		resolver.trusted = append(resolver.trusted, prefix.Masked())
+	}
+	return resolver, nil
+}
+
+// SetClientIPResolver replaces the resolver the rate limiters key on
+func SetClientIPResolver(resolver *ClientIPResolver) {
+	defaultResolver.Store(resolver)
+}
+
+// ClientIP returns the client address of a request as the rate limiters
+// see it, see SetClientIPResolver
+func ClientIP(x Exchange) string {
+	return getClientIP(x)
+}
+
+// RequestIP is ClientIP for a net/http request, e.g. in a login handler
+func RequestIP(r *http.Request) string {
+	return getClientIP(&httpExchange{r: r})
+}
+
+// ClientIP returns the client address of a request. When the peer is a
+// trusted proxy it walks the hops of the forwarding header from right to left
+// and returns the first one that is not a trusted proxy.
+func (r *ClientIPResolver) ClientIP(x Exchange) string {
+	remote, ok := parseHost(x.RemoteAddr())
+	if !ok {
+		return x.RemoteAddr()
+	}
+	client := remote
+
+	if r.isTrusted(remote) {
+		hops := r.hops(x.Header(string(r.header)))
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, ok := parseHost(hops[i])
+			if !ok {
+				// "unknown", an obfuscated name or garbage: stop at the last
+				// address a trusted proxy vouched for
+				break
+			}
+			client = hop
+			if !r.isTrusted(hop) {
+				break
+			}
+		}
+	}
+
+	return r.key(client)
+}
+
+// ForwardedHops returns the hops in the forwarding header of a request, in
+// order, e.g. to pass them on as X-Forwarded-For
+func (r *ClientIPResolver) ForwardedHops(header http.Header) []string {
+	return r.hops(strings.Join(header.Values(string(r.header)), ", "))
+}
+
+// hops parses the value of the forwarding header
+func (r *ClientIPResolver) hops(value string) []string {
+	if r.header == Forwarded {
+		return forwardedFor(value)
+	}
+	return splitList(value)
+}
+
+// TrustsPeer reports whether a peer address (as in RemoteAddr) is a trusted
+// proxy whose forwarding headers are believed
+func (r *ClientIPResolver) TrustsPeer(remoteAddr string) bool {
+	addr, ok := parseHost(remoteAddr)
+	return ok && r.isTrusted(addr)
+}
+
+// isTrusted reports whether an address is a trusted proxy
+func (r *ClientIPResolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range r.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// key formats a client address, aggregating IPv6 when configured
+func (r *ClientIPResolver) key(addr netip.Addr) string {
+	if addr.Is6() && r.ipv6Prefix > 0 {
+		prefix, _ := addr.Prefix(r.ipv6Prefix)
+		return prefix.String()
+	}
+	return addr.String()
+}
+
+// forwardedFor returns the for= values of a Forwarded header in order
+func forwardedFor(header string) []string {
+	var hops []string
+	for _, element := range splitList(header) {
+		for _, pair := range strings.Split(element, ";") {
+			name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if found && strings.EqualFold(name, "for") {
+				hops = append(hops, strings.Trim(value, `"`))
+			}
+		}
+	}
+	return hops
+}
+
+// splitList splits a comma separated header into trimmed, non-empty values
+func splitList(header string) []string {
+	var values []string
+	for _, value := range strings.Split(header, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// parseHost parses an address with or without port, as in RemoteAddr
+// ("1.2.3.4:5678", "[::1]:80") or forwarding headers ("[2001:db8::1]")
+func parseHost(value string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	// Zones are local to the host and IPv4-mapped IPv6 is plain IPv4
+	return addr.WithZone("").Unmap(), true
+}
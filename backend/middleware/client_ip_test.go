@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIPIgnoresSpoofedHeaders(t *testing.T) {
+	trusted := []string{"10.0.0.0/8"}
+	cases := []struct {
+		name    string
+		header  []ForwardingHeader
+		peer    string
+		headers map[string]string
+		want    string
+	}{
+		{"untrusted peer, X-Forwarded-For", nil, "203.0.113.9:1234", map[string]string{"X-Forwarded-For": "6.6.6.6"}, "203.0.113.9"},
+		{"untrusted peer, Forwarded", []ForwardingHeader{Forwarded}, "203.0.113.9:1234", map[string]string{"Forwarded": "for=6.6.6.6"}, "203.0.113.9"},
+		{"untrusted peer, X-Real-IP", nil, "203.0.113.9:1234", map[string]string{"X-Real-IP": "6.6.6.6"}, "203.0.113.9"},
+
+		{"trusted peer", nil, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1"}, "1.1.1.1"},
+		{"trusted peer, spoofed first hop", nil, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 1.1.1.1"}, "1.1.1.1"},
+		{"trusted peer, chain of proxies", nil, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 1.1.1.1, 10.0.0.2"}, "1.1.1.1"},
+		{"trusted peer, garbage hop", nil, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, nonsense"}, "10.0.0.1"},
+		{"trusted peer, spoofed Forwarded", nil, "10.0.0.1:1234", map[string]string{"Forwarded": "for=6.6.6.6", "X-Forwarded-For": "1.1.1.1"}, "1.1.1.1"},
+		{"trusted peer, no fallback to Forwarded", nil, "10.0.0.1:1234", map[string]string{"Forwarded": "for=6.6.6.6"}, "10.0.0.1"},
+		{"trusted peer, no fallback to X-Real-IP", nil, "10.0.0.1:1234", map[string]string{"X-Real-IP": "6.6.6.6"}, "10.0.0.1"},
+
+		{"Forwarded", []ForwardingHeader{Forwarded}, "10.0.0.1:1234", map[string]string{"Forwarded": `for="[2001:db8::1]:443";proto=https, for=10.0.0.2`}, "2001:db8::1"},
+		{"Forwarded, spoofed X-Forwarded-For", []ForwardingHeader{Forwarded}, "10.0.0.1:1234", map[string]string{"Forwarded": "for=1.1.1.1", "X-Forwarded-For": "6.6.6.6"}, "1.1.1.1"},
+		{"Forwarded, no fallback to X-Forwarded-For", []ForwardingHeader{Forwarded}, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "6.6.6.6"}, "10.0.0.1"},
+		{"X-Real-IP", []ForwardingHeader{XRealIP}, "10.0.0.1:1234", map[string]string{"X-Real-IP": "1.1.1.1", "X-Forwarded-For": "6.6.6.6"}, "1.1.1.1"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resolver, err := NewClientIPResolver(trusted, 0, tc.header...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/api/login", nil)
+			r.RemoteAddr = tc.peer
+			for name, value := range tc.headers {
+				r.Header.Set(name, value)
+			}
+			if got := resolver.ClientIP(&httpExchange{r: r}); got != tc.want {
+				t.Errorf("ClientIP = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientIPAggregatesIPv6(t *testing.T) {
+	resolver, err := NewClientIPResolver(nil, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "[2001:db8:1:2:3:4:5:6]:443"
+	if got := resolver.ClientIP(&httpExchange{r: r}); got != "2001:db8:1:2::/64" {
+		t.Errorf("ClientIP = %s, want 2001:db8:1:2::/64", got)
+	}
+}
+
+func TestNewClientIPResolverRejectsUnknownHeader(t *testing.T) {
+	if _, err := NewClientIPResolver(nil, 0, "X-Client-IP"); err == nil {
+		t.Error("no error for an unsupported header")
+	}
+}
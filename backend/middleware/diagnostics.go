@@ -0,0 +1,209 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DebugHeader asks for diagnostics. Its value is a token from SignDebugToken,
+// or any value for users allowed to manage the cache.
+const DebugHeader = "X-DKL-Debug"
+
+// DefaultDebugTokenMaxAge is how long a signed debug token stays valid
+const DefaultDebugTokenMaxAge = 5 * time.Minute
+
+// DiagnosticsConfig decides which requests get diagnostics headers
+type DiagnosticsConfig struct {
+	Secret      []byte            // HMAC key for debug tokens; empty disables tokens
+	MaxAge      time.Duration     // token lifetime; 0 uses DefaultDebugTokenMaxAge
+	Permissions PermissionChecker // users with cache:manage need no token
+}
+
+// Diagnostics collects Server-Timing metrics and cache details of a request.
+// All methods are no-ops on a nil *Diagnostics, so callers need not check
+// whether diagnostics are enabled.
+type Diagnostics struct {
+	mu      sync.Mutex
+	timings []serverTiming
+	headers map[string]string
+}
+
+type serverTiming struct {
+	name string
+	desc string
+	dur  time.Duration
+}
+
+type diagnosticsKey struct{}
+
+// diagnosticsFrom returns the diagnostics of a request, or nil when disabled
+func diagnosticsFrom(ctx context.Context) *Diagnostics {
+	d, _ := ctx.Value(diagnosticsKey{}).(*Diagnostics)
+	return d
+}
+
+// Add adds dur to the named Server-Timing metric; repeated calls accumulate.
+// A non-empty desc replaces the description.
+func (d *Diagnostics) Add(name, desc string, dur time.Duration) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i := range d.timings {
+		if d.timings[i].name == name {
+			d.timings[i].dur += dur
+			if desc != "" {
+				d.timings[i].desc = desc
+			}
+			return
+		}
+	}
+	d.timings = append(d.timings, serverTiming{name: name, desc: desc, dur: dur})
+}
+
+// Set adds a diagnostics header such as X-Cache-Key
+func (d *Diagnostics) Set(header, value string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.headers[header] = value
+}
+
+// writeHeaders adds the collected diagnostics to the response headers and
+// keeps CDNs and browsers from storing the response
+func (d *Diagnostics) writeHeaders(h http.Header) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	metrics := make([]string, 0, len(d.timings))
+	for _, t := range d.timings {
+		metric := t.name + ";dur=" + strconv.FormatFloat(float64(t.dur.Microseconds())/1000, 'f', 1, 64)
+		if t.desc != "" {
+			metric += `;desc="` + t.desc + `"`
+		}
+		metrics = append(metrics, metric)
+	}
+	if len(metrics) > 0 {
+		h.Add("Server-Timing", strings.Join(metrics, ", "))
+	}
+	for header, value := range d.headers {
+		h.Set(header, value)
+	}
+	h.Del("Surrogate-Control")
+	h.Set("Cache-Control", "private, no-store")
+}
+
+// DiagnosticsMiddleware enables diagnostics for requests with a valid
+// DebugHeader. Place it outside the rate limiters and caches it reports on.
+// It is net/http only: engines run through package fiberadapter never see
+// diagnostics and report nothing.
+func DiagnosticsMiddleware(config DiagnosticsConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !debugAllowed(r, config) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			diag := &Diagnostics{headers: make(map[string]string)}
+			ctx := context.WithValue(r.Context(), diagnosticsKey{}, diag)
+			next.ServeHTTP(&diagnosticsWriter{ResponseWriter: w, diag: diag}, r.WithContext(ctx))
+		})
+	}
+}
+
+// SignDebugToken returns a DebugHeader value valid for MaxAge from now
+func SignDebugToken(secret []byte, now time.Time) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	return ts + "." + debugSignature(secret, ts)
+}
+
+// debugAllowed reports whether a request asked for diagnostics and may see them
+func debugAllowed(r *http.Request, config DiagnosticsConfig) bool {
+	value := r.Header.Get(DebugHeader)
+	if value == "" {
+		return false
+	}
+	if config.Permissions != nil && config.Permissions(r, "cache", "manage") {
+		return true
+	}
+	if len(config.Secret) == 0 {
+		return false
+	}
+
+	ts, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	issued, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	maxAge := config.MaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultDebugTokenMaxAge
+	}
+	age := time.Since(time.Unix(issued, 0))
+	if age < -time.Minute || age > maxAge {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(debugSignature(config.Secret, ts)))
+}
+
+func debugSignature(secret []byte, ts string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// diagnosticsWriter adds the diagnostics headers just before the response
+// headers are sent
+type diagnosticsWriter struct {
+	http.ResponseWriter
+	diag        *Diagnostics
+	wroteHeader bool
+}
+
+func (w *diagnosticsWriter) WriteHeader(statusCode int) {
+	// Informational responses are sent before the final headers are known
+	if statusCode >= 200 && !w.wroteHeader {
+		w.wroteHeader = true
+		w.diag.writeHeaders(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *diagnosticsWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *diagnosticsWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *diagnosticsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *diagnosticsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
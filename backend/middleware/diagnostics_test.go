@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugAllowed(t *testing.T) {
+	secret := []byte("s3cret")
+	now := time.Now()
+	valid := SignDebugToken(secret, now)
+	ts, _, _ := strings.Cut(valid, ".")
+	managers := func(r *http.Request, resource, action string) bool {
+		return r.Header.Get("X-Test-Role") == "admin" && resource+":"+action == "cache:manage"
+	}
+
+	cases := []struct {
+		name   string
+		token  string
+		role   string
+		config DiagnosticsConfig
+		want   bool
+	}{
+		{"valid token", valid, "", DiagnosticsConfig{Secret: secret}, true},
+		{"no header", "", "", DiagnosticsConfig{Secret: secret}, false},
+		{"expired", SignDebugToken(secret, now.Add(-6*time.Minute)), "", DiagnosticsConfig{Secret: secret}, false},
+		{"within a custom max age", SignDebugToken(secret, now.Add(-6*time.Minute)), "", DiagnosticsConfig{Secret: secret, MaxAge: 10 * time.Minute}, true},
+		{"issued in the future", SignDebugToken(secret, now.Add(2*time.Minute)), "", DiagnosticsConfig{Secret: secret}, false},
+		{"small clock skew", SignDebugToken(secret, now.Add(30*time.Second)), "", DiagnosticsConfig{Secret: secret}, true},
+		{"other secret", SignDebugToken([]byte("other"), now), "", DiagnosticsConfig{Secret: secret}, false},
+		{"bad signature", ts + ".deadbeef", "", DiagnosticsConfig{Secret: secret}, false},
+		{"signature of another timestamp", strconv.FormatInt(now.Unix()-1, 10) + valid[len(ts):], "", DiagnosticsConfig{Secret: secret}, false},
+		{"no signature", ts, "", DiagnosticsConfig{Secret: secret}, false},
+		{"no timestamp", valid[len(ts):], "", DiagnosticsConfig{Secret: secret}, false},
+		{"timestamp not a number", "soon" + valid[len(ts):], "", DiagnosticsConfig{Secret: secret}, false},
+		{"tokens disabled", valid, "", DiagnosticsConfig{}, false},
+		{"cache manager", "1", "admin", DiagnosticsConfig{Permissions: managers}, true},
+		{"other user", "1", "user", DiagnosticsConfig{Permissions: managers}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/photos", nil)
+			if tc.token != "" {
+				r.Header.Set(DebugHeader, tc.token)
+			}
+			r.Header.Set("X-Test-Role", tc.role)
+			if got := debugAllowed(r, tc.config); got != tc.want {
+				t.Errorf("debugAllowed = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiagnosticsOnlyForDebugRequests(t *testing.T) {
+	setupRedis(t)
+	secret := []byte("s3cret")
+	handler := DiagnosticsMiddleware(DiagnosticsConfig{Secret: secret})(
+		SmartCacheMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`[{"id":1}]`))
+		})))
+	get := func(token string) http.Header {
+		r := httptest.NewRequest("GET", "/api/photos", nil)
+		if token != "" {
+			r.Header.Set(DebugHeader, token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Header()
+	}
+
+	if header := get(""); header.Get("Server-Timing") != "" || header.Get("X-Cache-Key") != "" {
+		t.Errorf("diagnostics without a token: %v", header)
+	}
+	header := get(SignDebugToken(secret, time.Now()))
+	if timing := header.Get("Server-Timing"); !strings.Contains(timing, "cache;dur=") || !strings.Contains(timing, "redis;dur=") {
+		t.Errorf("Server-Timing %q", timing)
+	}
+	if header.Get("X-Cache-Key") == "" || header.Get("X-Cache-Policy") != "photos" || header.Get("Cache-Control") != "private, no-store" {
+		t.Errorf("debug headers %v", header)
+	}
+}
@@ -0,0 +1,192 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Exchange is one request and its response as seen by the cache and rate
+// limit engines. It keeps them independent of the HTTP framework: HTTP wraps
+// an engine as net/http middleware, package fiberadapter as a Fiber handler.
+type Exchange interface {
+	Context() context.Context
+	Value(key any) any // request-scoped value, e.g. set by auth middleware
+	Method() string
+	Path() string
+	RawQuery() string
+	Header(name string) string // request header; repeated values are joined by ", "
+	Cookie(name string) (string, bool)
+	RemoteAddr() string
+
+	ResponseHeader(name string) string
+	SetHeader(name, value string)
+	AddHeader(name, value string)
+	DelHeader(name string)
+
+	// Next runs the wrapped handler, writing straight to the client
+	Next()
+
+	// Capture runs the wrapped handler and returns its response without
+	// sending it. ok is false when the response went out already because it
+	// was streamed, hijacked or larger than maxBody.
+	Capture(maxBody int) (status int, body []byte, ok bool)
+
+	// Intercept runs the wrapped handler and calls beforeSend with the final
+	// status right before the response headers are sent
+	Intercept(beforeSend func(status int))
+
+	// Send writes the final response; the body is left out for HEAD requests
+	Send(status int, body []byte)
+}
+
+// Engine is transport-independent middleware. It handles an exchange and
+// calls Next, Capture or Intercept to run the wrapped handler, or Send to
+// answer itself.
+type Engine func(x Exchange)
+
+// HTTP turns an engine into net/http middleware
+func HTTP(engine Engine) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			engine(&httpExchange{w: w, r: r, next: next})
+		})
+	}
+}
+
+// httpRequest returns the request of a net/http exchange, nil for other transports
+func httpRequest(x Exchange) *http.Request {
+	if hx, ok := x.(*httpExchange); ok {
+		return hx.r
+	}
+	return nil
+}
+
+// httpExchange implements Exchange for net/http
+type httpExchange struct {
+	w    http.ResponseWriter
+	r    *http.Request
+	next http.Handler
+}
+
+func (x *httpExchange) Context() context.Context { return x.r.Context() }
+func (x *httpExchange) Value(key any) any        { return x.r.Context().Value(key) }
+func (x *httpExchange) Method() string           { return x.r.Method }
+func (x *httpExchange) Path() string             { return x.r.URL.Path }
+func (x *httpExchange) RawQuery() string         { return x.r.URL.RawQuery }
+func (x *httpExchange) RemoteAddr() string       { return x.r.RemoteAddr }
+
+func (x *httpExchange) Header(name string) string {
+	values := x.r.Header.Values(name)
+	if len(values) == 1 {
+		return values[0]
+	}
+	return strings.Join(values, ", ")
+}
+
+func (x *httpExchange) Cookie(name string) (string, bool) {
+	cookie, err := x.r.Cookie(name)
+	if err != nil {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+func (x *httpExchange) ResponseHeader(name string) string { return x.w.Header().Get(name) }
+func (x *httpExchange) SetHeader(name, value string)      { x.w.Header().Set(name, value) }
+func (x *httpExchange) AddHeader(name, value string)      { x.w.Header().Add(name, value) }
+func (x *httpExchange) DelHeader(name string)             { x.w.Header().Del(name) }
+
+func (x *httpExchange) Next() {
+	x.next.ServeHTTP(x.w, x.r)
+}
+
+func (x *httpExchange) Capture(maxBody int) (int, []byte, bool) {
+	rec := NewResponseRecorder(x.w, maxBody)
+	x.next.ServeHTTP(rec, x.r)
+	if !rec.Buffered() {
+		return 0, nil, false
+	}
+	return rec.StatusCode(), rec.Body(), true
+}
+
+func (x *httpExchange) Intercept(beforeSend func(status int)) {
+	iw := &interceptWriter{ResponseWriter: x.w, beforeSend: beforeSend}
+	x.next.ServeHTTP(iw, x.r)
+
+	// Handlers that never write still answer 200
+	iw.commit(http.StatusOK)
+}
+
+func (x *httpExchange) Send(status int, body []byte) {
+	x.w.WriteHeader(status)
+	if x.r.Method != http.MethodHead {
+		x.w.Write(body)
+	}
+}
+
+// sendError answers with a plain text error, like http.Error
+func sendError(x Exchange, message string, status int) {
+	x.DelHeader("Content-Length")
+	x.SetHeader("Content-Type", "text/plain; charset=utf-8")
+	x.SetHeader("X-Content-Type-Options", "nosniff")
+	x.Send(status, []byte(message+"\n"))
+}
+
+// queryHas reports whether the query string of an exchange has a parameter
+func queryHas(x Exchange, name string) bool {
+	query, _ := url.ParseQuery(x.RawQuery())
+	return query.Has(name)
+}
+
+// interceptWriter calls beforeSend when the handler commits its final
+// status, before anything reaches the client
+type interceptWriter struct {
+	http.ResponseWriter
+	beforeSend func(status int)
+	committed  bool
+}
+
+// commit calls beforeSend once
+func (w *interceptWriter) commit(statusCode int) {
+	if w.committed {
+		return
+	}
+	w.committed = true
+	w.beforeSend(statusCode)
+}
+
+// WriteHeader commits the status and then writes it
+func (w *interceptWriter) WriteHeader(statusCode int) {
+	// Informational responses (103 Early Hints) are not the final status
+	if statusCode >= 200 {
+		w.commit(statusCode)
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write commits an implicit 200 before the first body bytes
+func (w *interceptWriter) Write(b []byte) (int, error) {
+	w.commit(http.StatusOK)
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush commits an implicit 200 and flushes, for streaming handlers
+func (w *interceptWriter) Flush() {
+	w.commit(http.StatusOK)
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack hands the connection to the handler; nothing is committed
+func (w *interceptWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.committed = true
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *interceptWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,181 @@
+// Package fiberadapter runs the cache and rate limit engines of package
+// middleware as Fiber handlers, with the same behaviour as their net/http
+// counterparts. It lives in its own package so net/http users do not pull
+// in Fiber.
+package fiberadapter
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/jeffreasy/dkl25/backend/middleware"
+)
+
+// New turns an engine into a Fiber handler
+func New(engine middleware.Engine) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		x := &exchange{c: c}
+		engine(x)
+		return x.err
+	}
+}
+
+// Cache is middleware.CacheMiddleware for Fiber
+func Cache(config middleware.CacheConfig) fiber.Handler {
+	return New(middleware.CacheEngine(config))
+}
+
+// SmartCache is middleware.SmartCacheWithPolicies for Fiber
+func SmartCache(policies *middleware.CachePolicyTable) fiber.Handler {
+	return New(middleware.SmartCacheEngine(policies))
+}
+
+// CacheInvalidation is middleware.CacheInvalidationWithConfig for Fiber
+func CacheInvalidation(config middleware.InvalidationConfig) fiber.Handler {
+	return New(middleware.CacheInvalidationEngine(config))
+}
+
+// RateLimit is middleware.RateLimitMiddleware for Fiber; set ExchangeKeyFunc,
+// as KeyFunc only sees net/http requests
+func RateLimit(config middleware.RateLimitConfig) fiber.Handler {
+	return New(middleware.RateLimitEngine(config))
+}
+
+// EndpointRateLimit is middleware.EndpointRateLimiter for Fiber
+func EndpointRateLimit(endpointConfigs map[string]middleware.RateLimitConfig) fiber.Handler {
+	return New(middleware.EndpointRateLimitEngine(endpointConfigs))
+}
+
+// PolicyRateLimit is middleware.PolicyRateLimitMiddleware for Fiber
+func PolicyRateLimit(config middleware.PolicyRateLimitConfig) fiber.Handler {
+	return New(middleware.PolicyRateLimitEngine(config))
+}
+
+// RoleRateLimit is middleware.RoleRateLimiter for Fiber
+func RoleRateLimit(quotas middleware.RoleQuotas) fiber.Handler {
+	return New(middleware.RoleRateLimitEngine(quotas))
+}
+
+// SetPrincipal stores the authenticated principal of a request for the
+// engines, as middleware.WithPrincipal does for net/http
+func SetPrincipal(c *fiber.Ctx, principal middleware.Principal) {
+	c.SetUserContext(middleware.WithPrincipal(c.UserContext(), principal))
+}
+
+// BruteForce is middleware.BruteForceMiddleware for Fiber
+func BruteForce(protector *middleware.BruteForceProtector) fiber.Handler {
+	return New(middleware.BruteForceEngine(protector))
+}
+
+// ClientIP is middleware.ClientIP for Fiber, e.g. to report login attempts
+func ClientIP(c *fiber.Ctx) string {
+	return middleware.ClientIP(&exchange{c: c})
+}
+
+// SlidingWindow is middleware.SlidingWindowRateLimiter for Fiber
+func SlidingWindow(requests int, window time.Duration) fiber.Handler {
+	return New(middleware.SlidingWindowEngine(requests, window))
+}
+
+// SlidingWindowCounter is middleware.SlidingWindowCounterRateLimiter for Fiber
+func SlidingWindowCounter(requests int, window time.Duration) fiber.Handler {
+	return New(middleware.SlidingWindowCounterEngine(requests, window))
+}
+
+// Burst is middleware.BurstRateLimiter for Fiber
+func Burst(burstSize, refillRate int, refillInterval time.Duration) fiber.Handler {
+	return New(middleware.BurstEngine(burstSize, refillRate, refillInterval))
+}
+
+// CostBased is middleware.CostBasedRateLimiter for Fiber
+func CostBased(costFunc func(middleware.Exchange) int, budget int, window time.Duration) fiber.Handler {
+	return New(middleware.CostBasedEngine(costFunc, budget, window))
+}
+
+// CostTable is middleware.CostTableRateLimiter for Fiber
+func CostTable(table middleware.CostTable, budget int, window time.Duration) fiber.Handler {
+	return New(middleware.CostTableEngine(table, budget, window))
+}
+
+// exchange implements middleware.Exchange for a Fiber context. Fiber sends
+// the response after the handler chain returns, so nothing the engine does
+// reaches the client early.
+type exchange struct {
+	c   *fiber.Ctx
+	err error // returned by the next handler, passed on to Fiber
+}
+
+func (x *exchange) Context() context.Context { return x.c.UserContext() }
+func (x *exchange) Method() string           { return x.c.Method() }
+func (x *exchange) Path() string             { return string(x.c.Request().URI().Path()) }
+func (x *exchange) RawQuery() string         { return string(x.c.Request().URI().QueryString()) }
+func (x *exchange) RemoteAddr() string       { return x.c.Context().RemoteAddr().String() }
+
+// Value prefers Fiber locals, where Fiber auth middleware stores the user
+func (x *exchange) Value(key any) any {
+	if value := x.c.Locals(key); value != nil {
+		return value
+	}
+	return x.c.UserContext().Value(key)
+}
+
+func (x *exchange) Header(name string) string {
+	values := x.c.Request().Header.PeekAll(name)
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = string(value)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (x *exchange) Cookie(name string) (string, bool) {
+	value := x.c.Request().Header.Cookie(name)
+	return string(value), value != nil
+}
+
+func (x *exchange) ResponseHeader(name string) string {
+	return string(x.c.Response().Header.Peek(name))
+}
+
+func (x *exchange) SetHeader(name, value string) { x.c.Response().Header.Set(name, value) }
+func (x *exchange) AddHeader(name, value string) { x.c.Response().Header.Add(name, value) }
+func (x *exchange) DelHeader(name string)        { x.c.Response().Header.Del(name) }
+
+func (x *exchange) Next() {
+	x.err = x.c.Next()
+}
+
+// Capture reports streamed, hijacked, oversized and failed responses as not
+// captured; Fiber sends them as they are
+func (x *exchange) Capture(maxBody int) (int, []byte, bool) {
+	if x.err = x.c.Next(); x.err != nil {
+		return 0, nil, false
+	}
+	if maxBody <= 0 {
+		maxBody = middleware.DefaultMaxCacheBodySize
+	}
+
+	resp := x.c.Response()
+	if resp.IsBodyStream() || x.c.Context().Hijacked() || len(resp.Body()) > maxBody {
+		return 0, nil, false
+	}
+	// Copy: the body buffer is reused once it is replaced
+	return resp.StatusCode(), append([]byte(nil), resp.Body()...), true
+}
+
+// Intercept skips beforeSend when the handler failed, as Fiber's error
+// handler decides that status later
+func (x *exchange) Intercept(beforeSend func(status int)) {
+	if x.err = x.c.Next(); x.err == nil {
+		beforeSend(x.c.Response().StatusCode())
+	}
+}
+
+// Send sets the response; fasthttp leaves the body out for HEAD requests
+func (x *exchange) Send(status int, body []byte) {
+	x.c.Status(status)
+	x.c.Response().SetBody(body)
+}
@@ -0,0 +1,282 @@
+package fiberadapter
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/jeffreasy/dkl25/backend/lib"
+	"github.com/jeffreasy/dkl25/backend/middleware"
+)
+
+// clientIP is the peer address of Fiber's test connection, used for the
+// net/http requests too so both transports see the same client
+const clientIP = "0.0.0.0"
+
+// bigBody is a JSON response larger than the cache's MaxBodySize below
+var bigBody = "[" + strings.Repeat("1,", 64) + "1]"
+
+// response is what a client received
+type response struct {
+	status int
+	header http.Header
+	body   string
+}
+
+// transport serves requests through engines wrapped around the test API
+type transport func(t *testing.T, engines []middleware.Engine, protector *middleware.BruteForceProtector) func(method, path string) response
+
+// httpTransport runs the engines as net/http middleware
+func httpTransport(t *testing.T, engines []middleware.Engine, protector *middleware.BruteForceProtector) func(method, path string) response {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/photos", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id":1}]`))
+	})
+	mux.HandleFunc("GET /api/photos/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(bigBody))
+	})
+	mux.HandleFunc("PUT /api/photos/conflict", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("conflict"))
+	})
+	mux.HandleFunc("PUT /api/photos/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	})
+	mux.HandleFunc("POST /api/login", func(w http.ResponseWriter, r *http.Request) {
+		protector.Failure(clientIP, "")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("invalid credentials"))
+	})
+
+	var handler http.Handler = mux
+	for i := len(engines) - 1; i >= 0; i-- {
+		handler = middleware.HTTP(engines[i])(handler)
+	}
+	return func(method, path string) response {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = clientIP + ":0"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return response{rec.Code, rec.Header(), rec.Body.String()}
+	}
+}
+
+// fiberTransport runs the engines as Fiber handlers
+func fiberTransport(t *testing.T, engines []middleware.Engine, protector *middleware.BruteForceProtector) func(method, path string) response {
+	app := fiber.New()
+	for _, engine := range engines {
+		app.Use(New(engine))
+	}
+	app.Get("/api/photos", func(c *fiber.Ctx) error {
+		c.Set("Content-Type", "application/json")
+		return c.SendString(`[{"id":1}]`)
+	})
+	app.Get("/api/photos/big", func(c *fiber.Ctx) error {
+		c.Set("Content-Type", "application/json")
+		return c.SendString(bigBody)
+	})
+	app.Put("/api/photos/conflict", func(c *fiber.Ctx) error {
+		return fiber.NewError(fiber.StatusConflict, "conflict")
+	})
+	app.Put("/api/photos/:id", func(c *fiber.Ctx) error {
+		c.Set("Content-Type", "application/json")
+		return c.SendString(`{}`)
+	})
+	app.Post("/api/login", func(c *fiber.Ctx) error {
+		protector.Failure(clientIP, "")
+		c.Set("Content-Type", "text/plain; charset=utf-8")
+		return c.Status(fiber.StatusUnauthorized).SendString("invalid credentials")
+	})
+
+	return func(method, path string) response {
+		resp, err := app.Test(httptest.NewRequest(method, path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response{resp.StatusCode, resp.Header, string(body)}
+	}
+}
+
+// step is a request and the response expected from either transport. An
+// empty header value means the header must be absent.
+type step struct {
+	method, path string
+	status       int
+	body         string
+	header       map[string]string
+}
+
+// TestEnginesMatchAcrossTransports runs each engine through HTTP and New and
+// expects the same responses from both
+func TestEnginesMatchAcrossTransports(t *testing.T) {
+	tooManyRequests := "Rate limit exceeded. Please try again later.\n"
+	tooManyFailures := "Too many failed attempts. Please try again later.\n"
+	photos := `[{"id":1}]`
+
+	cases := []struct {
+		name    string
+		engines func(p *middleware.BruteForceProtector) []middleware.Engine
+		steps   []step
+	}{
+		{
+			name: "cache",
+			engines: func(*middleware.BruteForceProtector) []middleware.Engine {
+				return []middleware.Engine{middleware.CacheEngine(middleware.CacheConfig{TTL: time.Minute, Prefix: "test", MaxBodySize: 64})}
+			},
+			steps: []step{
+				{"GET", "/api/photos", 200, photos, map[string]string{"X-Cache": "MISS", "Content-Type": "application/json"}},
+				{"GET", "/api/photos", 200, photos, map[string]string{"X-Cache": "HIT", "Content-Type": "application/json"}},
+				// Larger than MaxBodySize: passed through and never stored
+				{"GET", "/api/photos/big", 200, bigBody, map[string]string{"X-Cache": "MISS"}},
+				{"GET", "/api/photos/big", 200, bigBody, map[string]string{"X-Cache": "MISS"}},
+				{"HEAD", "/api/photos", 200, "", map[string]string{"X-Cache": "HIT"}},
+			},
+		},
+		{
+			name: "invalidation",
+			engines: func(*middleware.BruteForceProtector) []middleware.Engine {
+				return []middleware.Engine{
+					middleware.SmartCacheEngine(nil),
+					middleware.CacheInvalidationEngine(middleware.InvalidationConfig{Groups: []string{"photos"}, Routes: []string{"/api/photos/{id}"}}),
+				}
+			},
+			steps: []step{
+				{"GET", "/api/photos", 200, photos, map[string]string{"X-Cache": "MISS"}},
+				{"GET", "/api/photos", 200, photos, map[string]string{"X-Cache": "HIT"}},
+				// A failed write, an error returned to Fiber, purges nothing
+				{"PUT", "/api/photos/conflict", 409, "conflict", map[string]string{"X-Cache-Invalidated": ""}},
+				{"GET", "/api/photos", 200, photos, map[string]string{"X-Cache": "HIT"}},
+				{"PUT", "/api/photos/7", 200, `{}`, map[string]string{"X-Cache-Invalidated": "true"}},
+				{"GET", "/api/photos", 200, photos, map[string]string{"X-Cache": "MISS"}},
+			},
+		},
+		{
+			name: "rate limit",
+			engines: func(*middleware.BruteForceProtector) []middleware.Engine {
+				return []middleware.Engine{middleware.RateLimitEngine(middleware.RateLimitConfig{Requests: 2, Window: time.Minute})}
+			},
+			steps: []step{
+				{"GET", "/api/photos", 200, photos, map[string]string{"X-RateLimit-Limit": "2", "X-RateLimit-Remaining": "1"}},
+				{"GET", "/api/photos", 200, photos, map[string]string{"X-RateLimit-Remaining": "0"}},
+				{"GET", "/api/photos", 429, tooManyRequests, map[string]string{"Retry-After": "60", "Content-Type": "text/plain; charset=utf-8"}},
+			},
+		},
+		{
+			name: "brute force",
+			engines: func(p *middleware.BruteForceProtector) []middleware.Engine {
+				return []middleware.Engine{middleware.BruteForceEngine(p)}
+			},
+			steps: []step{
+				{"POST", "/api/login", 401, "invalid credentials", map[string]string{"Retry-After": ""}},
+				{"POST", "/api/login", 401, "invalid credentials", map[string]string{"Retry-After": ""}},
+				{"POST", "/api/login", 429, tooManyFailures, map[string]string{"Retry-After": "60"}},
+			},
+		},
+	}
+
+	transports := []struct {
+		name string
+		new  transport
+	}{{"http", httpTransport}, {"fiber", fiberTransport}}
+
+	for _, tc := range cases {
+		for _, tr := range transports {
+			t.Run(tc.name+"/"+tr.name, func(t *testing.T) {
+				mr := miniredis.RunT(t)
+				lib.RedisClient = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+				protector := middleware.NewBruteForceProtector(middleware.BruteForceConfig{IP: lib.Lockout{Threshold: 2}})
+				do := tr.new(t, tc.engines(protector), protector)
+				for i, s := range tc.steps {
+					got := do(s.method, s.path)
+					if got.status != s.status || got.body != s.body {
+						t.Fatalf("step %d %s %s: got %d %q, want %d %q", i, s.method, s.path, got.status, got.body, s.status, s.body)
+					}
+					for name, want := range s.header {
+						if value := got.header.Get(name); value != want {
+							t.Fatalf("step %d %s %s: %s = %q, want %q", i, s.method, s.path, name, value, want)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestInterceptSkipsFailedHandler checks beforeSend is not called when a
+// Fiber handler returns an error, as the error handler sets the status later
+func TestInterceptSkipsFailedHandler(t *testing.T) {
+	var statuses []int
+	app := fiber.New()
+	app.Use(New(func(x middleware.Exchange) {
+		x.Intercept(func(status int) { statuses = append(statuses, status) })
+	}))
+	app.Post("/ok", func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusCreated) })
+	app.Post("/fail", func(c *fiber.Ctx) error { return fiber.NewError(fiber.StatusConflict, "conflict") })
+
+	for _, path := range []string{"/ok", "/fail"} {
+		if _, err := app.Test(httptest.NewRequest("POST", path, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(statuses) != 1 || statuses[0] != fiber.StatusCreated {
+		t.Fatalf("beforeSend saw %v, want only 201", statuses)
+	}
+}
+
+// TestCaptureLimits checks which responses Capture leaves uncaptured and that
+// the client still receives them
+func TestCaptureLimits(t *testing.T) {
+	cases := []struct {
+		name    string
+		handler fiber.Handler
+		status  int
+		body    string
+		ok      bool
+	}{
+		{"small", func(c *fiber.Ctx) error { return c.SendString("1234") }, 200, "1234", true},
+		{"oversized", func(c *fiber.Ctx) error { return c.SendString("123456789") }, 200, "123456789", false},
+		{"streamed", func(c *fiber.Ctx) error { return c.SendStream(strings.NewReader("12")) }, 200, "12", false},
+		{"error", func(c *fiber.Ctx) error { return fiber.NewError(fiber.StatusTeapot, "teapot") }, 418, "teapot", false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var captured bool
+			app := fiber.New()
+			app.Use(New(func(x middleware.Exchange) {
+				status, body, ok := x.Capture(8)
+				if captured = ok; ok {
+					x.Send(status, body)
+				}
+			}))
+			app.Get("/", tc.handler)
+
+			resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if captured != tc.ok || resp.StatusCode != tc.status || string(body) != tc.body {
+				t.Fatalf("captured %v, got %d %q; want %v, %d %q", captured, resp.StatusCode, body, tc.ok, tc.status, tc.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package middleware
+
+import "net/http"
+
+// PermissionChecker reports whether the authenticated user of a request holds
+// a permission. The application's auth layer provides it, matching the
+// resource/action permissions served by /api/rbac/permissions.
+type PermissionChecker func(r *http.Request, resource, action string) bool
+
+// RequirePermission only lets requests through whose user holds resource:action
+func RequirePermission(check PermissionChecker, resource, action string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if check == nil || !check(r, resource, action) {
+				http.Error(w, "Missing permission "+resource+":"+action, http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
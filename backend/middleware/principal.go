@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"context"
+	"strings"
+)
+
+// Principal is the authenticated caller of a request: a user or a service
+// account. Roles and permissions are those of the RBAC system, as served by
+// /api/rbac/roles and /api/rbac/permissions.
+type Principal struct {
+	ID          string
+	Roles       []string // role names, e.g. "admin"
+	Permissions []string // "resource:action", e.g. "steps:write"
+}
+
+// HasRole reports whether the principal has a role
+func (p Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if strings.EqualFold(r, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission reports whether the principal holds resource:action
+func (p Principal) HasPermission(resource, action string) bool {
+	return containsString(p.Permissions, resource+":"+action)
+}
+
+// principalKey is the context key of the Principal
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying the principal; the auth middleware
+// calls it once the request is authenticated
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom returns the principal stored by WithPrincipal
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok && principal.ID != ""
+}
+
+// principalOf returns the principal of a request, if it is authenticated
+func principalOf(x Exchange) (Principal, bool) {
+	if principal, ok := x.Value(principalKey{}).(Principal); ok && principal.ID != "" {
+		return principal, true
+	}
+	// Older auth middleware only sets a "user_id" string
+	if userID, ok := x.Value("user_id").(string); ok && userID != "" {
+		return Principal{ID: userID}, true
+	}
+	return Principal{}, false
+}
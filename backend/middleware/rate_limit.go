@@ -2,7 +2,10 @@ package middleware
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jeffreasy/dkl25/backend/lib"
@@ -10,278 +13,442 @@ import (
 
 // RateLimitConfig holds rate limit configuration
 type RateLimitConfig struct {
-	Requests int                        // Number of allowed requests
-	Window   time.Duration              // Time window
-	KeyFunc  func(*http.Request) string // Function to generate rate limit key
+	Requests  int                        // Number of allowed requests
+	Window    time.Duration              // Time window
+	KeyFunc   func(*http.Request) string // Function to generate rate limit key
+	Algorithm RateLimitAlgorithm         // How requests are counted; default FixedWindow
+
+	// ExchangeKeyFunc replaces KeyFunc for any transport, e.g. Fiber. KeyFunc
+	// only sees net/http requests; elsewhere the client IP is used.
+	ExchangeKeyFunc func(Exchange) string
+
+	// Routes are templates such as "/api/photos/{id}" (see RoutePattern) that
+	// get a limit of their own per client. Requests matching none share one
+	// limit per client, so ids in paths do not multiply the buckets. Without
+	// Routes every path counts on its own.
+	Routes []string
+
+	// StandardHeaders adds the IETF RateLimit-Policy and RateLimit headers
+	// next to the X-RateLimit ones, with the limit called Name ("default")
+	StandardHeaders bool
+	Name            string
 }
 
-// RateLimitMiddleware provides request rate limiting
-func RateLimitMiddleware(config RateLimitConfig) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Get rate limit key
-			var key string
-			if config.KeyFunc != nil {
-				key = config.KeyFunc(r)
-			} else {
-				key = getClientIP(r)
-			}
+// RateLimitAlgorithm selects how RateLimitEngine counts requests against
+// Requests per Window
+type RateLimitAlgorithm string
+
+const (
+	// FixedWindow counts per window starting at a client's first request; a
+	// client can send up to twice the limit around a window boundary
+	FixedWindow RateLimitAlgorithm = ""
+	// SlidingLog enforces the limit in any window-long period, storing an
+	// entry per request
+	SlidingLog RateLimitAlgorithm = "sliding_log"
+	// SlidingWindowCounter approximates SlidingLog with two counters
+	SlidingWindowCounter RateLimitAlgorithm = "sliding_window_counter"
+	// TokenBucket allows a burst of Requests, refilled at Requests per Window
+	TokenBucket RateLimitAlgorithm = "token_bucket"
+	// GCRA allows a burst of Requests from idle and then paces requests
+	// evenly at one per Window/Requests, with a single key per client
+	GCRA RateLimitAlgorithm = "gcra"
+)
 
-			// Create rate limit key in Redis
-			rateLimitKey := lib.CacheKey("ratelimit", r.URL.Path, key)
+// RateLimitMiddleware provides request rate limiting per client and path, or
+// per route template when Routes are set
+func RateLimitMiddleware(config RateLimitConfig) func(http.Handler) http.Handler {
+	return HTTP(RateLimitEngine(config))
+}
 
-			// Increment counter
-			count, err := lib.Increment(rateLimitKey)
-			if err != nil {
-				// If Redis fails, allow request to continue
-				http.Error(w, "Rate limit check failed", http.StatusInternalServerError)
-				return
+// RateLimitEngine is the transport-independent core of RateLimitMiddleware.
+// It panics unless Requests is positive, Window at least a millisecond and
+// the Routes are valid templates.
+func RateLimitEngine(config RateLimitConfig) Engine {
+	for _, route := range config.Routes {
+		if err := validateRoutePattern(route); err != nil {
+			panic(fmt.Sprintf("rate limiter: %v", err))
+		}
+	}
+	keyFunc := config.ExchangeKeyFunc
+	if keyFunc == nil && config.KeyFunc != nil {
+		keyFunc = func(x Exchange) string {
+			if r := httpRequest(x); r != nil {
+				return config.KeyFunc(r)
 			}
+			return getClientIP(x)
+		}
+	}
+	if keyFunc == nil {
+		keyFunc = getClientIP
+	}
 
-			// Set expiry on first request
-			if count == 1 {
-				if err := lib.SetExpiry(rateLimitKey, config.Window); err != nil {
-					// Log error but continue
-					fmt.Printf("Failed to set rate limit expiry: %v\n", err)
-				}
-			}
+	l := algorithmLimiter(config)
+	if config.StandardHeaders {
+		l.policyName = config.Name
+		if l.policyName == "" {
+			l.policyName = "default"
+		}
+	}
 
-			// Add rate limit headers
-			w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", config.Requests))
-			w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", max(0, config.Requests-int(count))))
-			w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", time.Now().Add(config.Window).Unix()))
+	return limiterEngine(func(x Exchange) string {
+		route := rateLimitRoute(config.Routes, x.Path())
+		if config.Algorithm == FixedWindow {
+			return lib.CacheKey("ratelimit", route, keyFunc(x))
+		}
+		return lib.CacheKey("ratelimit", string(config.Algorithm), route, keyFunc(x))
+	}, l)
+}
 
-			// Check if limit exceeded
-			if count > int64(config.Requests) {
-				w.Header().Set("Retry-After", fmt.Sprintf("%d", int(config.Window.Seconds())))
-				http.Error(w, "Rate limit exceeded. Please try again later.", http.StatusTooManyRequests)
-				return
-			}
+// rateLimitRoute returns the first route template matching path, or "*" for
+// the limit shared by all other paths. Without routes it returns path.
+func rateLimitRoute(routes []string, path string) string {
+	if len(routes) == 0 {
+		return path
+	}
+	for _, route := range routes {
+		if _, ok := matchRoute(route, path); ok {
+			return route
+		}
+	}
+	return "*"
+}
 
-			next.ServeHTTP(w, r)
-		})
+// algorithmLimiter returns the limiter for config.Algorithm. It panics
+// unless Requests is positive and Window at least a millisecond.
+func algorithmLimiter(config RateLimitConfig) *limiter {
+	requests, window := config.Requests, config.Window
+	if requests <= 0 || window < time.Millisecond {
+		panic(fmt.Sprintf("rate limiter: %d requests per %s; requests must be positive and the window at least 1ms", requests, window))
 	}
+	return newLimiter(requests, window, func(key string, _ int) (lib.RateLimitResult, error) {
+		switch config.Algorithm {
+		case SlidingLog:
+			return lib.SlidingLog(key, requests, window)
+		case SlidingWindowCounter:
+			return lib.SlidingWindowCounter(key, requests, window)
+		case TokenBucket:
+			return lib.TokenBucket(key, requests, requests, window)
+		case GCRA:
+			return lib.GCRA(key, requests, window)
+		default:
+			return lib.FixedWindow(key, requests, window)
+		}
+	})
 }
 
-// IPRateLimiter creates a rate limiter based on client IP
-func IPRateLimiter(requests int, window time.Duration) func(http.Handler) http.Handler {
+// IPRateLimiter creates a rate limiter based on client IP. An algorithm can
+// be passed to replace the default FixedWindow.
+func IPRateLimiter(requests int, window time.Duration, algorithm ...RateLimitAlgorithm) func(http.Handler) http.Handler {
 	return RateLimitMiddleware(RateLimitConfig{
-		Requests: requests,
-		Window:   window,
-		KeyFunc:  getClientIP,
+		Requests:  requests,
+		Window:    window,
+		Algorithm: optionalAlgorithm(algorithm),
 	})
 }
 
-// UserRateLimiter creates a rate limiter based on user ID (requires auth)
-func UserRateLimiter(requests int, window time.Duration) func(http.Handler) http.Handler {
+// UserRateLimiter creates a rate limiter based on user ID (requires auth). An
+// algorithm can be passed to replace the default FixedWindow. RoleRateLimiter
+// gives roles different limits.
+func UserRateLimiter(requests int, window time.Duration, algorithm ...RateLimitAlgorithm) func(http.Handler) http.Handler {
 	return RateLimitMiddleware(RateLimitConfig{
-		Requests: requests,
-		Window:   window,
-		KeyFunc: func(r *http.Request) string {
-			// Try to get user ID from context (set by auth middleware)
-			if userID := r.Context().Value("user_id"); userID != nil {
-				return userID.(string)
+		Requests:  requests,
+		Window:    window,
+		Algorithm: optionalAlgorithm(algorithm),
+		ExchangeKeyFunc: func(x Exchange) string {
+			// The principal set by the auth middleware, see WithPrincipal
+			if principal, ok := principalOf(x); ok {
+				return principal.ID
 			}
 			// Fallback to IP
-			return getClientIP(r)
+			return getClientIP(x)
 		},
 	})
 }
 
-// EndpointRateLimiter creates endpoint-specific rate limiters
+// optionalAlgorithm returns the algorithm passed to a limiter constructor
+func optionalAlgorithm(algorithm []RateLimitAlgorithm) RateLimitAlgorithm {
+	if len(algorithm) == 0 {
+		return FixedWindow
+	}
+	return algorithm[0]
+}
+
+// EndpointRateLimiter creates endpoint-specific rate limiters for exact
+// paths; PolicyRateLimitMiddleware also matches route patterns
 func EndpointRateLimiter(endpointConfigs map[string]RateLimitConfig) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Check if we have a specific config for this endpoint
-			if config, exists := endpointConfigs[r.URL.Path]; exists {
-				middleware := RateLimitMiddleware(config)
-				middleware(next).ServeHTTP(w, r)
-				return
-			}
+	return HTTP(EndpointRateLimitEngine(endpointConfigs))
+}
 
-			// No rate limiting for this endpoint
-			next.ServeHTTP(w, r)
-		})
+// EndpointRateLimitEngine is the transport-independent core of EndpointRateLimiter
+func EndpointRateLimitEngine(endpointConfigs map[string]RateLimitConfig) Engine {
+	engines := make(map[string]Engine, len(endpointConfigs))
+	for path, config := range endpointConfigs {
+		// Every endpoint counts on its own
+		config.Routes = []string{path}
+		engines[path] = RateLimitEngine(config)
+	}
+
+	return func(x Exchange) {
+		// Check if we have a specific config for this endpoint
+		if engine, exists := engines[x.Path()]; exists {
+			engine(x)
+			return
+		}
+
+		// No rate limiting for this endpoint
+		x.Next()
 	}
 }
 
 // SlidingWindowRateLimiter implements sliding window rate limiting
 func SlidingWindowRateLimiter(requests int, window time.Duration) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			clientIP := getClientIP(r)
-			key := lib.CacheKey("ratelimit", "sliding", r.URL.Path, clientIP)
-
-			// Get current timestamp
-			now := time.Now().UnixMilli()
-			windowStart := now - window.Milliseconds()
-
-			// Remove old entries (older than window)
-			// This would require a sorted set in Redis for perfect implementation
-			// For now, use simplified approach with counter + timestamp
-
-			// Check current count
-			countKey := key + ":count"
-			timestampKey := key + ":ts"
-
-			// Get last reset timestamp
-			var lastReset int64
-			if err := lib.GetCache(timestampKey, &lastReset); err != nil {
-				lastReset = now
-				lib.SetCache(timestampKey, now, window)
-			}
+	return HTTP(SlidingWindowEngine(requests, window))
+}
 
-			// If window has passed, reset counter
-			if now-lastReset > window.Milliseconds() {
-				lib.DeleteCache(countKey)
-				lib.SetCache(timestampKey, now, window)
-				lastReset = now
-			}
+// SlidingWindowEngine is the transport-independent core of SlidingWindowRateLimiter.
+// It logs every allowed request in a sorted set, so the limit holds in any
+// window-long period, not just per fixed window.
+func SlidingWindowEngine(requests int, window time.Duration) Engine {
+	return RateLimitEngine(RateLimitConfig{Requests: requests, Window: window, Algorithm: SlidingLog})
+}
 
-			// Increment counter
-			count, err := lib.Increment(countKey)
-			if err != nil {
-				http.Error(w, "Rate limit check failed", http.StatusInternalServerError)
-				return
-			}
+// SlidingWindowCounterRateLimiter approximates SlidingWindowRateLimiter with
+// two counters per client instead of an entry per request
+func SlidingWindowCounterRateLimiter(requests int, window time.Duration) func(http.Handler) http.Handler {
+	return HTTP(SlidingWindowCounterEngine(requests, window))
+}
 
-			// Set expiry
-			if count == 1 {
-				lib.SetExpiry(countKey, window)
-			}
+// SlidingWindowCounterEngine is the transport-independent core of SlidingWindowCounterRateLimiter
+func SlidingWindowCounterEngine(requests int, window time.Duration) Engine {
+	return RateLimitEngine(RateLimitConfig{Requests: requests, Window: window, Algorithm: SlidingWindowCounter})
+}
 
-			// Calculate remaining time in window
-			remaining := window.Milliseconds() - (now - lastReset)
+// limiterEngine checks a request against a limiter, reports the result in
+// the X-RateLimit headers and rejects the request when it is denied
+func limiterEngine(key func(x Exchange) string, l *limiter) Engine {
+	return func(x Exchange) {
+		diag, start := diagnosticsFrom(x.Context()), time.Now()
+		result, mode := l.allow(key(x), 1)
+		diag.Add("ratelimit", "", time.Since(start))
+
+		x.SetHeader("X-RateLimit-Limit", fmt.Sprintf("%d", result.Limit))
+		x.SetHeader("X-RateLimit-Remaining", fmt.Sprintf("%d", result.Remaining))
+		x.SetHeader("X-RateLimit-Reset", fmt.Sprintf("%d", time.Now().Add(result.ResetAfter).Unix()))
+		x.SetHeader("X-RateLimit-Mode", mode)
+		if l.policyName != "" {
+			setStandardHeaders(x, headerLimit{name: l.policyName, window: l.window, result: result})
+		}
+
+		if !result.Allowed {
+			rateLimitMetrics.denied.Add(1)
+			x.SetHeader("Retry-After", fmt.Sprintf("%d", retryAfterSeconds(result.RetryAfter)))
+			sendError(x, "Rate limit exceeded. Please try again later.", http.StatusTooManyRequests)
+			return
+		}
+
+		x.Next()
+	}
+}
 
-			// Add headers
-			w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", requests))
-			w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", max(0, requests-int(count))))
-			w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", time.Now().Add(time.Duration(remaining)*time.Millisecond).Unix()))
+// headerLimit is one limit reported in the standard headers
+type headerLimit struct {
+	name   string
+	window time.Duration
+	result lib.RateLimitResult
+}
 
-			// Check limit
-			if count > int64(requests) {
-				w.Header().Set("Retry-After", fmt.Sprintf("%d", remaining/1000))
-				http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
-				return
-			}
+// setStandardHeaders reports limits in the RateLimit-Policy and RateLimit
+// headers of the IETF httpapi draft, e.g.
+//
+//	RateLimit-Policy: "minute";q=5;w=60, "day";q=50;w=86400
+//	RateLimit: "minute";r=4;t=17, "day";r=42;t=3600
+func setStandardHeaders(x Exchange, limits ...headerLimit) {
+	policies := make([]string, len(limits))
+	states := make([]string, len(limits))
+	for i, limit := range limits {
+		name := strconv.Quote(limit.name)
+		policies[i] = fmt.Sprintf("%s;q=%d;w=%d", name, limit.result.Limit, int64(limit.window.Seconds()))
+		states[i] = fmt.Sprintf("%s;r=%d;t=%d", name, limit.result.Remaining, int64(math.Ceil(limit.result.ResetAfter.Seconds())))
+	}
+	x.SetHeader("RateLimit-Policy", strings.Join(policies, ", "))
+	x.SetHeader("RateLimit", strings.Join(states, ", "))
+}
 
-			next.ServeHTTP(w, r)
-		})
+// retryAfterSeconds rounds a wait up to whole seconds, as Retry-After needs,
+// so clients never retry too early
+func retryAfterSeconds(wait time.Duration) int64 {
+	seconds := int64((wait + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
 	}
+	return seconds
 }
 
 // BurstRateLimiter allows bursts of requests with token bucket algorithm
 func BurstRateLimiter(burstSize, refillRate int, refillInterval time.Duration) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			clientIP := getClientIP(r)
-			tokensKey := lib.CacheKey("ratelimit", "burst", "tokens", clientIP)
-			lastRefillKey := lib.CacheKey("ratelimit", "burst", "refill", clientIP)
-
-			// Get current tokens
-			var tokens int
-			if err := lib.GetCache(tokensKey, &tokens); err != nil {
-				// Initialize with burst size
-				tokens = burstSize
-				lib.SetCache(tokensKey, tokens, 24*time.Hour)
-			}
+	return HTTP(BurstEngine(burstSize, refillRate, refillInterval))
+}
 
-			// Get last refill time
-			var lastRefill int64
-			if err := lib.GetCache(lastRefillKey, &lastRefill); err != nil {
-				lastRefill = time.Now().Unix()
-				lib.SetCache(lastRefillKey, lastRefill, 24*time.Hour)
-			}
+// BurstEngine is the transport-independent core of BurstRateLimiter. The
+// bucket refills continuously, so a client waiting half an interval gets half
+// of refillRate back. It panics unless burstSize and refillRate are positive
+// and refillInterval is at least a millisecond.
+func BurstEngine(burstSize, refillRate int, refillInterval time.Duration) Engine {
+	if burstSize <= 0 || refillRate <= 0 || refillInterval < time.Millisecond {
+		panic(fmt.Sprintf("burst rate limiter: burst size %d and refill rate %d must be positive and refill interval %s at least 1ms", burstSize, refillRate, refillInterval))
+	}
+	// The local fallback refills the whole burst in this time
+	refillAll := refillInterval * time.Duration(burstSize) / time.Duration(refillRate)
+
+	return limiterEngine(func(x Exchange) string {
+		return lib.CacheKey("ratelimit", "burst", getClientIP(x))
+	}, newLimiter(burstSize, refillAll, func(key string, _ int) (lib.RateLimitResult, error) {
+		return lib.TokenBucket(key, burstSize, refillRate, refillInterval)
+	}))
+}
 
-			// Calculate tokens to add based on time passed
-			now := time.Now().Unix()
-			timePassed := now - lastRefill
-			intervalsCount := int(timePassed / int64(refillInterval.Seconds()))
-
-			if intervalsCount > 0 {
-				tokensToAdd := intervalsCount * refillRate
-				tokens = min(burstSize, tokens+tokensToAdd)
-				lastRefill = now
-				lib.SetCache(tokensKey, tokens, 24*time.Hour)
-				lib.SetCache(lastRefillKey, lastRefill, 24*time.Hour)
-			}
+// CostBasedRateLimiter allows different costs for different endpoints.
+// A CostTable's RequestCost method can be passed as costFunc.
+func CostBasedRateLimiter(costFunc func(*http.Request) int, budget int, window time.Duration) func(http.Handler) http.Handler {
+	return HTTP(CostBasedEngine(func(x Exchange) int {
+		return costFunc(httpRequest(x))
+	}, budget, window))
+}
 
-			// Check if we have tokens
-			if tokens <= 0 {
-				w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", burstSize))
-				w.Header().Set("X-RateLimit-Remaining", "0")
-				w.Header().Set("Retry-After", fmt.Sprintf("%d", int(refillInterval.Seconds())))
-				http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
-				return
-			}
+// CostBasedEngine is the transport-independent core of CostBasedRateLimiter,
+// pricing exchanges with costFunc, e.g. a CostTable's Cost method. The budget
+// window starts at a client's first request and is not extended by later ones.
+// It panics unless budget is positive and window at least a millisecond.
+func CostBasedEngine(costFunc func(Exchange) int, budget int, window time.Duration) Engine {
+	if budget <= 0 || window < time.Millisecond {
+		panic(fmt.Sprintf("cost based rate limiter: budget %d per %s; the budget must be positive and the window at least 1ms", budget, window))
+	}
+	l := newLimiter(budget, window, func(key string, cost int) (lib.RateLimitResult, error) {
+		return lib.ConsumeBudget(key, cost, budget, window)
+	})
 
-			// Consume a token
-			tokens--
-			lib.SetCache(tokensKey, tokens, 24*time.Hour)
+	return func(x Exchange) {
+		diag, start := diagnosticsFrom(x.Context()), time.Now()
 
-			// Add headers
-			w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", burstSize))
-			w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", tokens))
+		budgetKey := lib.CacheKey("ratelimit", "cost", getClientIP(x))
+		cost := costFunc(x)
 
-			next.ServeHTTP(w, r)
-		})
+		result, mode := l.allow(budgetKey, cost)
+		diag.Add("ratelimit", "", time.Since(start))
+
+		// Add headers
+		// The limit is this instance's share of the budget in local mode
+		x.SetHeader("X-RateLimit-Budget", fmt.Sprintf("%d", result.Limit))
+		x.SetHeader("X-RateLimit-Used", fmt.Sprintf("%d", result.Limit-result.Remaining))
+		x.SetHeader("X-RateLimit-Cost", fmt.Sprintf("%d", cost))
+		x.SetHeader("X-RateLimit-Remaining", fmt.Sprintf("%d", result.Remaining))
+		x.SetHeader("X-RateLimit-Reset", fmt.Sprintf("%d", time.Now().Add(result.ResetAfter).Unix()))
+		x.SetHeader("X-RateLimit-Mode", mode)
+
+		if !result.Allowed {
+			rateLimitMetrics.denied.Add(1)
+			x.SetHeader("Retry-After", fmt.Sprintf("%d", retryAfterSeconds(result.RetryAfter)))
+			sendError(x, "Rate limit budget exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		x.Next()
 	}
 }
 
-// CostBasedRateLimiter allows different costs for different endpoints
-func CostBasedRateLimiter(costFunc func(*http.Request) int, budget int, window time.Duration) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			clientIP := getClientIP(r)
-			budgetKey := lib.CacheKey("ratelimit", "cost", clientIP)
-
-			// Get current budget used
-			var used int
-			if err := lib.GetCache(budgetKey, &used); err != nil {
-				used = 0
-				lib.SetCache(budgetKey, used, window)
-			}
+// RouteCost is the cost of requests matching a route pattern (see
+// RoutePattern); no methods means every method
+type RouteCost struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods,omitempty"`
+	Cost    int      `json:"cost"`
+}
 
-			// Calculate cost for this request
-			cost := costFunc(r)
+// CostTable prices requests by route for CostTableRateLimiter. The first
+// matching route wins; requests matching none cost Default.
+//
+//	costs := middleware.CostTable{Default: 1, Routes: []middleware.RouteCost{
+//		{Path: "/api/chat", Methods: []string{"POST"}, Cost: 10},
+//		{Path: "/api/photos/*", Methods: []string{"GET"}, Cost: 1},
+//	}}
+//	router.Use(middleware.CostTableRateLimiter(costs, 100, time.Minute))
+type CostTable struct {
+	Routes  []RouteCost `json:"routes"`
+	Default int         `json:"default"`
+}
 
-			// Check if budget allows this request
-			if used+cost > budget {
-				w.Header().Set("X-RateLimit-Budget", fmt.Sprintf("%d", budget))
-				w.Header().Set("X-RateLimit-Used", fmt.Sprintf("%d", used))
-				w.Header().Set("X-RateLimit-Cost", fmt.Sprintf("%d", cost))
-				http.Error(w, "Rate limit budget exceeded", http.StatusTooManyRequests)
-				return
-			}
+// Validate checks the route patterns and costs
+func (t CostTable) Validate() error {
+	if t.Default < 0 {
+		return fmt.Errorf("cost table: negative default cost")
+	}
+	for _, route := range t.Routes {
+		if err := validateRoutePattern(route.Path); err != nil {
+			return fmt.Errorf("cost table: %w", err)
+		}
+		if route.Cost < 0 {
+			return fmt.Errorf("cost table: route %q has a negative cost", route.Path)
+		}
+	}
+	return nil
+}
 
-			// Consume budget
-			used += cost
-			lib.SetCache(budgetKey, used, window)
+// validateBudget checks the table and that every cost fits in budget; a
+// request costing more would be denied forever
+func (t CostTable) validateBudget(budget int) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	if t.Default > budget {
+		return fmt.Errorf("cost table: default cost %d exceeds the budget of %d", t.Default, budget)
+	}
+	for _, route := range t.Routes {
+		if route.Cost > budget {
+			return fmt.Errorf("cost table: route %q costs %d, more than the budget of %d", route.Path, route.Cost, budget)
+		}
+	}
+	return nil
+}
 
-			// Add headers
-			w.Header().Set("X-RateLimit-Budget", fmt.Sprintf("%d", budget))
-			w.Header().Set("X-RateLimit-Used", fmt.Sprintf("%d", used))
-			w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", budget-used))
+// CostTableRateLimiter is CostBasedRateLimiter priced by a cost table
+func CostTableRateLimiter(table CostTable, budget int, window time.Duration) func(http.Handler) http.Handler {
+	return HTTP(CostTableEngine(table, budget, window))
+}
 
-			next.ServeHTTP(w, r)
-		})
+// CostTableEngine is the transport-independent core of CostTableRateLimiter.
+// It panics when the table is invalid or prices a route above the budget.
+func CostTableEngine(table CostTable, budget int, window time.Duration) Engine {
+	if err := table.validateBudget(budget); err != nil {
+		panic(err.Error())
 	}
+	return CostBasedEngine(table.Cost, budget, window)
 }
 
-// Helper: Get client IP from request
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header (proxy/load balancer)
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		return xff
-	}
+// Cost returns the cost of an exchange, for CostBasedEngine
+func (t CostTable) Cost(x Exchange) int {
+	return t.cost(x.Method(), x.Path())
+}
+
+// RequestCost returns the cost of a request, for CostBasedRateLimiter
+func (t CostTable) RequestCost(r *http.Request) int {
+	return t.cost(r.Method, r.URL.Path)
+}
 
-	// Check X-Real-IP header
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
+func (t CostTable) cost(method, path string) int {
+	for _, route := range t.Routes {
+		if len(route.Methods) > 0 && !methodAllowed(route.Methods, method) {
+			continue
+		}
+		if _, ok := matchRoute(route.Path, path); ok {
+			return route.Cost
+		}
 	}
+	return t.Default
+}
 
-	// Use RemoteAddr
-	return r.RemoteAddr
+// Helper: Get client IP from request, see ClientIPResolver
+func getClientIP(x Exchange) string {
+	return defaultResolver.Load().ClientIP(x)
 }
 
 // Helper functions
@@ -0,0 +1,189 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffreasy/dkl25/backend/lib"
+)
+
+// Rate limit modes, reported in X-RateLimit-Mode and RateLimitStats
+const (
+	RateLimitModeRedis = "redis" // shared limits in Redis
+	RateLimitModeLocal = "local" // per-instance limits while Redis is unavailable
+)
+
+// localShards spreads local buckets over locks so clients do not contend
+const localShards = 32
+
+// rateLimitInstances is the number of API instances sharing the limits, see
+// SetRateLimitInstances
+var rateLimitInstances atomic.Int64
+
+func init() {
+	instances, _ := strconv.Atoi(os.Getenv("RATE_LIMIT_INSTANCES"))
+	SetRateLimitInstances(instances)
+}
+
+// SetRateLimitInstances sets how many instances run the rate limiters
+// (default RATE_LIMIT_INSTANCES, or 1). While Redis is unavailable each
+// instance enforces its share of every limit, so the total stays about the same.
+func SetRateLimitInstances(instances int) {
+	if instances < 1 {
+		instances = 1
+	}
+	rateLimitInstances.Store(int64(instances))
+}
+
+// RateLimitCounters shows how this instance has been limiting. They are per
+// instance; add them up across instances for a global view.
+type RateLimitCounters struct {
+	Mode        string `json:"mode"` // RateLimitModeRedis or RateLimitModeLocal
+	Instances   int    `json:"instances"`
+	RedisChecks int64  `json:"redis_checks"`
+	LocalChecks int64  `json:"local_checks"`
+	Denied      int64  `json:"denied"`
+}
+
+var rateLimitMetrics struct {
+	redisChecks atomic.Int64
+	localChecks atomic.Int64
+	denied      atomic.Int64
+}
+
+// RateLimitStats returns a snapshot of the rate limit counters
+func RateLimitStats() RateLimitCounters {
+	mode := RateLimitModeRedis
+	if lib.RateLimitCircuit.Open() {
+		mode = RateLimitModeLocal
+	}
+	return RateLimitCounters{
+		Mode:        mode,
+		Instances:   int(rateLimitInstances.Load()),
+		RedisChecks: rateLimitMetrics.redisChecks.Load(),
+		LocalChecks: rateLimitMetrics.localChecks.Load(),
+		Denied:      rateLimitMetrics.denied.Load(),
+	}
+}
+
+// limiter is one rate limit: an atomic check in Redis, and an in-process
+// token bucket of limit per window that takes over while Redis is unavailable
+type limiter struct {
+	check  func(key string, cost int) (lib.RateLimitResult, error)
+	limit  int
+	window time.Duration
+	local  localLimiter
+
+	// policyName enables the standard RateLimit headers, see RateLimitConfig
+	policyName string
+}
+
+func newLimiter(limit int, window time.Duration, check func(key string, cost int) (lib.RateLimitResult, error)) *limiter {
+	return &limiter{check: check, limit: limit, window: window}
+}
+
+// allow takes cost from key's limit and reports which mode decided. Redis is
+// tried first; lib.RateLimitCircuit makes that fail fast during an outage and
+// lets a probe through now and then, so Redis takes over again once it is back.
+func (l *limiter) allow(key string, cost int) (lib.RateLimitResult, string) {
+	result, err := l.check(key, cost)
+	if err == nil {
+		rateLimitMetrics.redisChecks.Add(1)
+		return result, RateLimitModeRedis
+	}
+	if !errors.Is(err, lib.ErrCircuitOpen) {
+		fmt.Printf("Rate limit check failed, limiting locally: %v\n", err)
+	}
+
+	rateLimitMetrics.localChecks.Add(1)
+	instances := int(rateLimitInstances.Load())
+	share := (l.limit + instances - 1) / instances
+	return l.local.take(key, cost, share, l.window), RateLimitModeLocal
+}
+
+// localLimiter is a sharded in-process token bucket per key
+type localLimiter struct {
+	shards [localShards]localShard
+}
+
+type localShard struct {
+	mu      sync.Mutex
+	buckets map[string]*localBucket
+	inserts int
+}
+
+type localBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes cost tokens from a bucket of capacity limit that refills
+// completely in window
+func (l *localLimiter) take(key string, cost, limit int, window time.Duration) lib.RateLimitResult {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	shard := &l.shards[hash.Sum32()%localShards]
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := shard.buckets[key]
+	if !ok {
+		if shard.buckets == nil {
+			shard.buckets = make(map[string]*localBucket)
+		}
+		shard.sweep(now, window)
+		bucket = &localBucket{tokens: float64(limit), last: now}
+		shard.buckets[key] = bucket
+	}
+
+	perNanosecond := float64(limit) / float64(window)
+	bucket.tokens = math.Min(float64(limit), bucket.tokens+float64(now.Sub(bucket.last))*perNanosecond)
+	bucket.last = now
+
+	result := lib.RateLimitResult{Limit: limit}
+	if bucket.tokens >= float64(cost) {
+		bucket.tokens -= float64(cost)
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration(math.Ceil((float64(cost) - bucket.tokens) / perNanosecond))
+	}
+	result.Remaining = int(bucket.tokens)
+	result.ResetAfter = time.Duration(math.Ceil((float64(limit) - bucket.tokens) / perNanosecond))
+	return result
+}
+
+// refund gives back cost tokens taken from a bucket of capacity limit
+func (l *localLimiter) refund(key string, cost, limit int) {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	shard := &l.shards[hash.Sum32()%localShards]
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if bucket, ok := shard.buckets[key]; ok {
+		bucket.tokens = math.Min(float64(limit), bucket.tokens+float64(cost))
+	}
+}
+
+// sweep drops buckets idle for a whole window every 1024 new keys; they are
+// full again, the same as a new bucket
+func (s *localShard) sweep(now time.Time, window time.Duration) {
+	if s.inserts++; s.inserts%1024 != 0 {
+		return
+	}
+	for key, bucket := range s.buckets {
+		if now.Sub(bucket.last) > window {
+			delete(s.buckets, key)
+		}
+	}
+}
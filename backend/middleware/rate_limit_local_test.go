@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jeffreasy/dkl25/backend/lib"
+)
+
+// useTestCircuit gives lib.RateLimitCircuit a short cooldown for one test
+func useTestCircuit(t *testing.T, cooldown time.Duration) {
+	t.Helper()
+	old := lib.RateLimitCircuit
+	lib.RateLimitCircuit = &lib.Circuit{Name: "test", Threshold: 2, Cooldown: cooldown}
+	t.Cleanup(func() { lib.RateLimitCircuit = old })
+}
+
+func TestRateLimitFallsBackWhileRedisIsDown(t *testing.T) {
+	useTestCircuit(t, 100*time.Millisecond)
+	SetRateLimitInstances(2)
+	defer SetRateLimitInstances(1)
+
+	for _, algorithm := range []RateLimitAlgorithm{FixedWindow, SlidingLog, SlidingWindowCounter, TokenBucket, GCRA} {
+		name := string(algorithm)
+		if algorithm == FixedWindow {
+			name = "fixed_window"
+		}
+		t.Run(name, func(t *testing.T) {
+			mr := setupRedis(t)
+			handler := IPRateLimiter(10, time.Minute, algorithm)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			send := func() *httptest.ResponseRecorder {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/photos", nil))
+				return rec
+			}
+
+			if rec := send(); rec.Header().Get("X-RateLimit-Mode") != RateLimitModeRedis {
+				t.Fatalf("mode %q with Redis up", rec.Header().Get("X-RateLimit-Mode"))
+			}
+			mr.Close()
+
+			// Each of the 2 instances allows half of the 10 requests
+			codes := make(map[int]int)
+			var last *httptest.ResponseRecorder
+			for i := 0; i < 8; i++ {
+				last = send()
+				if mode := last.Header().Get("X-RateLimit-Mode"); mode != RateLimitModeLocal {
+					t.Fatalf("request %d: mode %q with Redis down", i, mode)
+				}
+				codes[last.Code]++
+			}
+			if codes[200] != 5 || codes[429] != 3 {
+				t.Errorf("local limit: %v, want 5 allowed and 3 denied", codes)
+			}
+			// The local bucket refills 5 per minute: one every 12s
+			if retry := last.Header().Get("Retry-After"); retry != "12" {
+				t.Errorf("local Retry-After %q, want 12", retry)
+			}
+			if stats := RateLimitStats(); stats.Mode != RateLimitModeLocal || stats.Instances != 2 {
+				t.Errorf("stats %+v", stats)
+			}
+
+			// Redis takes over again after the cooldown
+			if err := mr.Restart(); err != nil {
+				t.Fatal(err)
+			}
+			if rec := send(); rec.Header().Get("X-RateLimit-Mode") != RateLimitModeLocal {
+				t.Errorf("mode %q during the cooldown", rec.Header().Get("X-RateLimit-Mode"))
+			}
+			time.Sleep(150 * time.Millisecond)
+			if rec := send(); rec.Header().Get("X-RateLimit-Mode") != RateLimitModeRedis || RateLimitStats().Mode != RateLimitModeRedis {
+				t.Errorf("mode %q after the cooldown", rec.Header().Get("X-RateLimit-Mode"))
+			}
+		})
+	}
+}
+
+func TestSetRateLimitInstances(t *testing.T) {
+	defer SetRateLimitInstances(1)
+	for _, tc := range []struct{ instances, want int }{{3, 3}, {0, 1}, {-2, 1}} {
+		SetRateLimitInstances(tc.instances)
+		if got := RateLimitStats().Instances; got != tc.want {
+			t.Errorf("SetRateLimitInstances(%d): %d instances, want %d", tc.instances, got, tc.want)
+		}
+	}
+}
+
+func TestLocalLimiterRefills(t *testing.T) {
+	var local localLimiter
+	for i := 0; i < 3; i++ {
+		if result := local.take("client", 1, 3, 300*time.Millisecond); !result.Allowed {
+			t.Fatalf("request %d denied", i)
+		}
+	}
+	result := local.take("client", 1, 3, 300*time.Millisecond)
+	if result.Allowed || result.RetryAfter <= 0 || result.RetryAfter > 100*time.Millisecond {
+		t.Fatalf("empty bucket: %+v, want denied for up to 100ms", result)
+	}
+
+	time.Sleep(result.RetryAfter + 5*time.Millisecond)
+	if result := local.take("client", 1, 3, 300*time.Millisecond); !result.Allowed {
+		t.Errorf("after RetryAfter: %+v", result)
+	}
+	if result := local.take("other", 1, 3, 300*time.Millisecond); !result.Allowed || result.Remaining != 2 {
+		t.Errorf("other client: %+v", result)
+	}
+}
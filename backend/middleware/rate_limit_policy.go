@@ -0,0 +1,261 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jeffreasy/dkl25/backend/lib"
+)
+
+// RateLimit is one limit of a rate limit policy, e.g. 5 per minute
+type RateLimit struct {
+	Name     string   `json:"name,omitempty"` // required when a policy has several limits
+	Requests int      `json:"requests"`
+	Window   Duration `json:"window"`
+}
+
+// RateLimitPolicy limits a group of routes. Its routes share the buckets: all
+// of /api/users/{id} counts as one route, whatever the id. A request must fit
+// in every limit and is counted against all of them or, when denied, none.
+// Routes without methods match every method.
+type RateLimitPolicy struct {
+	Name   string         `json:"name"`
+	Routes []RoutePattern `json:"routes"`
+	Limits []RateLimit    `json:"limits"`
+}
+
+// validate checks a policy is complete and its routes are well formed
+func (p *RateLimitPolicy) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("rate limit policy: name is required")
+	}
+	if len(p.Routes) == 0 {
+		return fmt.Errorf("rate limit policy %s: at least one route is required", p.Name)
+	}
+	for _, route := range p.Routes {
+		if err := validateRoutePattern(route.Path); err != nil {
+			return fmt.Errorf("rate limit policy %s: %w", p.Name, err)
+		}
+	}
+	if len(p.Limits) == 0 {
+		return fmt.Errorf("rate limit policy %s: at least one limit is required", p.Name)
+	}
+	names := make(map[string]bool, len(p.Limits))
+	for _, limit := range p.Limits {
+		if limit.Requests <= 0 || limit.Window < Duration(time.Millisecond) {
+			return fmt.Errorf("rate limit policy %s: limits need positive requests and window", p.Name)
+		}
+		if len(p.Limits) > 1 && limit.Name == "" {
+			return fmt.Errorf("rate limit policy %s: limits need a name when there are several", p.Name)
+		}
+		if names[limit.Name] {
+			return fmt.Errorf("rate limit policy %s: duplicate limit %q", p.Name, limit.Name)
+		}
+		names[limit.Name] = true
+	}
+	return nil
+}
+
+// match returns the route of the policy matching a request
+func (p *RateLimitPolicy) match(method, path string) (RoutePattern, bool) {
+	for _, route := range p.Routes {
+		if len(route.Methods) > 0 && !methodAllowed(route.Methods, method) {
+			continue
+		}
+		if _, ok := matchRoute(route.Path, path); ok {
+			return route, true
+		}
+	}
+	return RoutePattern{}, false
+}
+
+// limitName returns the name a limit is keyed and reported under
+func (l RateLimit) limitName() string {
+	if l.Name == "" {
+		return "default"
+	}
+	return l.Name
+}
+
+// RateLimitPolicyTable is an ordered list of rate limit policies. The first
+// policy that matches a request wins; requests matching none are not limited.
+//
+//	policies, err := middleware.NewRateLimitPolicyTable([]middleware.RateLimitPolicy{
+//		{Name: "contact", Routes: []middleware.RoutePattern{{Path: "/api/contact", Methods: []string{"POST"}}},
+//			Limits: []middleware.RateLimit{
+//				{Name: "minute", Requests: 5, Window: middleware.Duration(time.Minute)},
+//				{Name: "day", Requests: 50, Window: middleware.Duration(24 * time.Hour)},
+//			}},
+//		{Name: "users", Routes: []middleware.RoutePattern{{Path: "/api/users/{id}"}},
+//			Limits: []middleware.RateLimit{{Requests: 100, Window: middleware.Duration(time.Minute)}}},
+//	})
+type RateLimitPolicyTable struct {
+	policies []RateLimitPolicy
+	local    [][]localLimiter // per policy and limit, while Redis is unavailable
+}
+
+// NewRateLimitPolicyTable validates the policies and returns a table holding them
+func NewRateLimitPolicyTable(policies []RateLimitPolicy) (*RateLimitPolicyTable, error) {
+	names := make(map[string]bool, len(policies))
+	t := &RateLimitPolicyTable{policies: policies, local: make([][]localLimiter, len(policies))}
+	for i := range policies {
+		if err := policies[i].validate(); err != nil {
+			return nil, err
+		}
+		if names[policies[i].Name] {
+			return nil, fmt.Errorf("rate limit policy %s is defined twice", policies[i].Name)
+		}
+		names[policies[i].Name] = true
+		t.local[i] = make([]localLimiter, len(policies[i].Limits))
+	}
+	return t, nil
+}
+
+// Policies returns a copy of the policies
+func (t *RateLimitPolicyTable) Policies() []RateLimitPolicy {
+	policies := make([]RateLimitPolicy, len(t.policies))
+	copy(policies, t.policies)
+	return policies
+}
+
+// match returns the index of the policy matching a request and its route
+func (t *RateLimitPolicyTable) match(method, path string) (int, RoutePattern, bool) {
+	for i := range t.policies {
+		if route, ok := t.policies[i].match(method, path); ok {
+			return i, route, true
+		}
+	}
+	return 0, RoutePattern{}, false
+}
+
+// allow checks a request against all limits of a policy, one key per limit,
+// and reports which mode decided
+func (t *RateLimitPolicyTable) allow(policy int, keys []string) (bool, []lib.RateLimitResult, string) {
+	limits := t.policies[policy].Limits
+	stack := make([]lib.Limit, len(limits))
+	for i, limit := range limits {
+		stack[i] = lib.Limit{Requests: limit.Requests, Window: time.Duration(limit.Window)}
+	}
+
+	allowed, results, err := lib.SlidingWindowCounters(keys, stack)
+	if err == nil {
+		rateLimitMetrics.redisChecks.Add(1)
+		return allowed, results, RateLimitModeRedis
+	}
+	if !errors.Is(err, lib.ErrCircuitOpen) {
+		fmt.Printf("Rate limit check failed, limiting locally: %v\n", err)
+	}
+
+	rateLimitMetrics.localChecks.Add(1)
+	instances := int(rateLimitInstances.Load())
+	results = make([]lib.RateLimitResult, len(limits))
+	allowed = true
+	for i, limit := range limits {
+		share := (limit.Requests + instances - 1) / instances
+		results[i] = t.local[policy][i].take(keys[i], 1, share, time.Duration(limit.Window))
+		allowed = allowed && results[i].Allowed
+	}
+	if !allowed {
+		// Like in Redis a denied request counts against none of the limits
+		for i := range limits {
+			if results[i].Allowed {
+				t.local[policy][i].refund(keys[i], 1, results[i].Limit)
+				results[i].Remaining++
+			}
+		}
+	}
+	return allowed, results, RateLimitModeLocal
+}
+
+// PolicyRateLimitConfig configures PolicyRateLimitMiddleware
+type PolicyRateLimitConfig struct {
+	Policies *RateLimitPolicyTable
+	KeyFunc  func(Exchange) string // client key; default the client IP
+
+	// StandardHeaders adds the IETF RateLimit-Policy and RateLimit headers,
+	// listing every limit of the policy
+	StandardHeaders bool
+}
+
+// PolicyRateLimitMiddleware limits requests by route policy
+func PolicyRateLimitMiddleware(config PolicyRateLimitConfig) func(http.Handler) http.Handler {
+	return HTTP(PolicyRateLimitEngine(config))
+}
+
+// PolicyRateLimitEngine is the transport-independent core of
+// PolicyRateLimitMiddleware. Keys are built from the policy and the route
+// pattern, never the concrete path, so ids in paths do not multiply buckets.
+// The X-RateLimit headers report the limit that binds: the denying limit
+// with the longest wait, otherwise the one with the fewest requests left.
+func PolicyRateLimitEngine(config PolicyRateLimitConfig) Engine {
+	keyFunc := config.KeyFunc
+	if keyFunc == nil {
+		keyFunc = getClientIP
+	}
+
+	return func(x Exchange) {
+		index, route, ok := config.Policies.match(x.Method(), x.Path())
+		if !ok {
+			x.Next()
+			return
+		}
+		policy := config.Policies.policies[index]
+
+		diag, start := diagnosticsFrom(x.Context()), time.Now()
+		client := keyFunc(x)
+		keys := make([]string, len(policy.Limits))
+		for i, limit := range policy.Limits {
+			keys[i] = lib.CacheKey("ratelimit", "route", policy.Name, route.Path, limit.limitName(), client)
+		}
+		allowed, results, mode := config.Policies.allow(index, keys)
+		diag.Add("ratelimit", policy.Name, time.Since(start))
+
+		binding := bindingLimit(results)
+		result := results[binding]
+		x.SetHeader("X-RateLimit-Limit", fmt.Sprintf("%d", result.Limit))
+		x.SetHeader("X-RateLimit-Remaining", fmt.Sprintf("%d", result.Remaining))
+		x.SetHeader("X-RateLimit-Reset", fmt.Sprintf("%d", time.Now().Add(result.ResetAfter).Unix()))
+		x.SetHeader("X-RateLimit-Mode", mode)
+		if config.StandardHeaders {
+			limits := make([]headerLimit, 0, len(policy.Limits))
+			for i, limit := range policy.Limits {
+				limits = append(limits, headerLimit{name: limit.limitName(), window: time.Duration(limit.Window), result: results[i]})
+			}
+			setStandardHeaders(x, limits...)
+		}
+
+		if !allowed {
+			rateLimitMetrics.denied.Add(1)
+			x.SetHeader("Retry-After", fmt.Sprintf("%d", retryAfterSeconds(result.RetryAfter)))
+			sendError(x, "Rate limit exceeded. Please try again later.", http.StatusTooManyRequests)
+			return
+		}
+
+		x.Next()
+	}
+}
+
+// bindingLimit returns the index of the result that decides: the denied one
+// with the longest wait, or when all allow, the one with the fewest left
+func bindingLimit(results []lib.RateLimitResult) int {
+	binding := -1
+	for i, result := range results {
+		if result.Allowed || (binding >= 0 && result.RetryAfter <= results[binding].RetryAfter) {
+			continue
+		}
+		binding = i
+	}
+	if binding >= 0 {
+		return binding
+	}
+
+	binding = 0
+	for i, result := range results {
+		if result.Remaining < results[binding].Remaining {
+			binding = i
+		}
+	}
+	return binding
+}
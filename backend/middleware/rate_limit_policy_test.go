@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stackedPolicyHandler limits POST /api/contact to 2 per minute and 3 per day
+func stackedPolicyHandler(t *testing.T) func(method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	policies, err := NewRateLimitPolicyTable([]RateLimitPolicy{
+		{Name: "contact", Routes: []RoutePattern{{Path: "/api/contact", Methods: []string{"POST"}}},
+			Limits: []RateLimit{
+				{Name: "minute", Requests: 2, Window: Duration(time.Minute)},
+				{Name: "day", Requests: 3, Window: Duration(24 * time.Hour)},
+			}},
+		{Name: "users", Routes: []RoutePattern{{Path: "/api/users/{id}"}},
+			Limits: []RateLimit{{Requests: 2, Window: Duration(time.Minute)}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := PolicyRateLimitMiddleware(PolicyRateLimitConfig{Policies: policies, StandardHeaders: true})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	return func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+}
+
+func TestPolicyRateLimitStacksLimits(t *testing.T) {
+	setupRedis(t)
+	send := stackedPolicyHandler(t)
+
+	for i := 0; i < 2; i++ {
+		if rec := send("POST", "/api/contact"); rec.Code != 200 {
+			t.Fatalf("request %d: %d", i, rec.Code)
+		}
+	}
+	// The minute limit binds; the denied request does not count for the day
+	rec := send("POST", "/api/contact")
+	if rec.Code != 429 || rec.Header().Get("X-RateLimit-Limit") != "2" {
+		t.Errorf("third request: %d X-RateLimit-Limit %q, want 429 from the minute limit", rec.Code, rec.Header().Get("X-RateLimit-Limit"))
+	}
+	if got, want := rec.Header().Get("RateLimit-Policy"), `"minute";q=2;w=60, "day";q=3;w=86400`; got != want {
+		t.Errorf("RateLimit-Policy %q, want %q", got, want)
+	}
+	if state := send("POST", "/api/contact").Header().Get("RateLimit"); !hasLimitState(state, `"day";r=1;`) {
+		t.Errorf("RateLimit %q, want 1 left for the day after denied requests", state)
+	}
+
+	// Other methods match no policy
+	if rec := send("GET", "/api/contact"); rec.Code != 200 || rec.Header().Get("X-RateLimit-Limit") != "" {
+		t.Errorf("GET: %d X-RateLimit-Limit %q, want 200 without a limit", rec.Code, rec.Header().Get("X-RateLimit-Limit"))
+	}
+	// Ids share the route's limit
+	for i, path := range []string{"/api/users/1", "/api/users/2", "/api/users/3"} {
+		if got, want := send("GET", path).Code, []int{200, 200, 429}[i]; got != want {
+			t.Errorf("%s: %d, want %d", path, got, want)
+		}
+	}
+}
+
+func TestPolicyRateLimitRefundsLocally(t *testing.T) {
+	mr := setupRedis(t)
+	useTestCircuit(t, time.Hour)
+	send := stackedPolicyHandler(t)
+	mr.Close()
+
+	for i := 0; i < 2; i++ {
+		if rec := send("POST", "/api/contact"); rec.Code != 200 || rec.Header().Get("X-RateLimit-Mode") != RateLimitModeLocal {
+			t.Fatalf("request %d: %d in mode %q", i, rec.Code, rec.Header().Get("X-RateLimit-Mode"))
+		}
+	}
+	// The day limit gets back the token the denied requests took
+	for i := 0; i < 3; i++ {
+		rec := send("POST", "/api/contact")
+		if rec.Code != 429 || !hasLimitState(rec.Header().Get("RateLimit"), `"day";r=1;`) {
+			t.Errorf("denied request %d: %d RateLimit %q, want 429 with 1 left for the day", i, rec.Code, rec.Header().Get("RateLimit"))
+		}
+	}
+}
+
+// hasLimitState reports whether a RateLimit header holds state, e.g. `"day";r=1;`
+func hasLimitState(header, state string) bool {
+	for _, part := range strings.Split(header, ", ") {
+		if strings.HasPrefix(part, state) {
+			return true
+		}
+	}
+	return false
+}
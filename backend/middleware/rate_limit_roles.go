@@ -0,0 +1,211 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jeffreasy/dkl25/backend/config"
+	"github.com/jeffreasy/dkl25/backend/lib"
+)
+
+// RoleQuota is the rate limit of principals holding a role or a permission
+type RoleQuota struct {
+	Role       string   `json:"role,omitempty"`       // RBAC role name, e.g. "admin"
+	Permission string   `json:"permission,omitempty"` // "resource:action", e.g. "steps:write"
+	Requests   int      `json:"requests"`
+	Window     Duration `json:"window"`
+}
+
+// name returns the role or permission of a quota
+func (q RoleQuota) name() string {
+	if q.Role != "" {
+		return q.Role
+	}
+	return q.Permission
+}
+
+// rate returns the requests per second a quota allows
+func (q RoleQuota) rate() float64 {
+	return float64(q.Requests) / time.Duration(q.Window).Seconds()
+}
+
+// matches reports whether a principal holds the quota's role or permission
+func (q RoleQuota) matches(principal Principal) bool {
+	if q.Role != "" {
+		return principal.HasRole(q.Role)
+	}
+	resource, action, _ := strings.Cut(q.Permission, ":")
+	return principal.HasPermission(resource, action)
+}
+
+// RoleQuotas gives principals the rate limit of their roles and permissions,
+// so admins and service accounts get more than users and anonymous clients
+// the least. It uses the role names of /api/rbac/roles; see LoadRoleQuotas
+// and DefaultRoleQuotas.
+type RoleQuotas struct {
+	// Quotas per role or permission. A principal matching several gets the
+	// most generous one.
+	Quotas    []RoleQuota        `json:"quotas"`
+	User      RoleQuota          `json:"user"`      // authenticated, no matching quota
+	Anonymous RoleQuota          `json:"anonymous"` // keyed by client IP
+	Algorithm RateLimitAlgorithm `json:"algorithm,omitempty"`
+
+	// StandardHeaders adds the IETF RateLimit headers, named after the role,
+	// permission, "user" or "anonymous"
+	StandardHeaders bool `json:"standard_headers,omitempty"`
+}
+
+// LoadRoleQuotas reads and validates a JSON quota file, e.g.
+//
+//	{
+//	  "anonymous": {"requests": 60, "window": "1m"},
+//	  "user": {"requests": 300, "window": "1m"},
+//	  "quotas": [{"role": "admin", "requests": 1200, "window": "1m"}]
+//	}
+func LoadRoleQuotas(path string) (*RoleQuotas, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("role quota file: %w", err)
+	}
+
+	quotas, err := parseRoleQuotas(data)
+	if err != nil {
+		return nil, fmt.Errorf("role quota file %s: %w", path, err)
+	}
+	return quotas, nil
+}
+
+// DefaultRoleQuotas returns the built-in quotas: config/role_quotas.json,
+// embedded at build time
+func DefaultRoleQuotas() RoleQuotas {
+	quotas, err := parseRoleQuotas(config.RoleQuotas)
+	if err != nil {
+		panic(fmt.Sprintf("embedded role quotas: %v", err))
+	}
+	return *quotas
+}
+
+// parseRoleQuotas decodes and validates the contents of a quota file
+func parseRoleQuotas(data []byte) (*RoleQuotas, error) {
+	var quotas RoleQuotas
+	if err := json.Unmarshal(data, &quotas); err != nil {
+		return nil, err
+	}
+	if err := quotas.Validate(); err != nil {
+		return nil, err
+	}
+	return &quotas, nil
+}
+
+// Validate checks every quota has a positive limit and a single role or permission
+func (q *RoleQuotas) Validate() error {
+	switch q.Algorithm {
+	case FixedWindow, SlidingLog, SlidingWindowCounter, TokenBucket, GCRA:
+	default:
+		return fmt.Errorf("role quotas: unknown algorithm %q", q.Algorithm)
+	}
+
+	for _, fallback := range []struct {
+		name  string
+		quota RoleQuota
+	}{{"user", q.User}, {"anonymous", q.Anonymous}} {
+		name, quota := fallback.name, fallback.quota
+		if quota.Role != "" || quota.Permission != "" {
+			return fmt.Errorf("role quotas: the %s quota cannot have a role or permission", name)
+		}
+		if quota.Requests <= 0 || quota.Window < Duration(time.Millisecond) {
+			return fmt.Errorf("role quotas: the %s quota needs positive requests and window", name)
+		}
+	}
+
+	seen := make(map[string]bool, len(q.Quotas))
+	for _, quota := range q.Quotas {
+		name := quota.name()
+		if (quota.Role == "") == (quota.Permission == "") {
+			return fmt.Errorf("role quotas: a quota needs either a role or a permission")
+		}
+		if resource, action, ok := strings.Cut(quota.Permission, ":"); quota.Permission != "" && (!ok || resource == "" || action == "") {
+			return fmt.Errorf("role quotas: permission %q must be resource:action", quota.Permission)
+		}
+		if quota.Requests <= 0 || quota.Window < Duration(time.Millisecond) {
+			return fmt.Errorf("role quotas: quota %s needs positive requests and window", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("role quotas: quota %s is defined twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// Role returns the quota of a role, e.g. to show next to it in /api/rbac/roles
+func (q *RoleQuotas) Role(role string) (RoleQuota, bool) {
+	for _, quota := range q.Quotas {
+		if strings.EqualFold(quota.Role, role) {
+			return quota, true
+		}
+	}
+	return RoleQuota{}, false
+}
+
+// RoleRateLimiter limits principals by role, see RoleQuotas
+func RoleRateLimiter(quotas RoleQuotas) func(http.Handler) http.Handler {
+	return HTTP(RoleRateLimitEngine(quotas))
+}
+
+// RoleRateLimitEngine is the transport-independent core of RoleRateLimiter.
+// A quota counts across all paths, per principal ID or, for anonymous
+// clients, per client IP. It panics when the quotas do not pass Validate.
+func RoleRateLimitEngine(quotas RoleQuotas) Engine {
+	if err := quotas.Validate(); err != nil {
+		panic(fmt.Sprintf("role rate limiter: %v", err))
+	}
+	algorithm := string(quotas.Algorithm)
+	if algorithm == "" {
+		algorithm = "fixed_window"
+	}
+	engine := func(quota RoleQuota, name string, key func(Exchange) string) Engine {
+		l := algorithmLimiter(RateLimitConfig{Requests: quota.Requests, Window: time.Duration(quota.Window), Algorithm: quotas.Algorithm})
+		if quotas.StandardHeaders {
+			l.policyName = name
+		}
+		return limiterEngine(func(x Exchange) string {
+			return lib.CacheKey("ratelimit", "quota", algorithm, name, key(x))
+		}, l)
+	}
+	principalID := func(x Exchange) string {
+		principal, _ := principalOf(x)
+		return principal.ID
+	}
+
+	roleEngines := make([]Engine, len(quotas.Quotas))
+	for i, quota := range quotas.Quotas {
+		roleEngines[i] = engine(quota, quota.name(), principalID)
+	}
+	userEngine := engine(quotas.User, "user", principalID)
+	anonymousEngine := engine(quotas.Anonymous, "anonymous", getClientIP)
+
+	return func(x Exchange) {
+		principal, ok := principalOf(x)
+		if !ok {
+			anonymousEngine(x)
+			return
+		}
+
+		best := -1
+		for i, quota := range quotas.Quotas {
+			if quota.matches(principal) && (best < 0 || quota.rate() > quotas.Quotas[best].rate()) {
+				best = i
+			}
+		}
+		if best < 0 {
+			userEngine(x)
+			return
+		}
+		roleEngines[best](x)
+	}
+}
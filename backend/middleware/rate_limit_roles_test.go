@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultRoleQuotasMatchConfigFile(t *testing.T) {
+	file, err := LoadRoleQuotas("../config/role_quotas.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := json.Marshal(file)
+	got, _ := json.Marshal(DefaultRoleQuotas())
+	if string(got) != string(want) {
+		t.Fatalf("defaults differ from config/role_quotas.json:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestRoleRateLimitEngineRejectsInvalidQuotas(t *testing.T) {
+	valid := func() RoleQuotas {
+		return RoleQuotas{
+			User:      RoleQuota{Requests: 300, Window: Duration(time.Minute)},
+			Anonymous: RoleQuota{Requests: 60, Window: Duration(time.Minute)},
+		}
+	}
+	for name, change := range map[string]func(*RoleQuotas){
+		"zero user window":  func(q *RoleQuotas) { q.User.Window = 0 },
+		"missing anonymous": func(q *RoleQuotas) { q.Anonymous = RoleQuota{} },
+		"zero role window":  func(q *RoleQuotas) { q.Quotas = []RoleQuota{{Role: "admin", Requests: 10}} },
+		"role and permission": func(q *RoleQuotas) {
+			q.Quotas = []RoleQuota{{Role: "admin", Permission: "steps:write", Requests: 1, Window: Duration(time.Minute)}}
+		},
+		"unknown algorithm": func(q *RoleQuotas) { q.Algorithm = "leaky_bucket" },
+		"malformed permission": func(q *RoleQuotas) {
+			q.Quotas = []RoleQuota{{Permission: "steps", Requests: 1, Window: Duration(time.Minute)}}
+		},
+	} {
+		quotas := valid()
+		change(&quotas)
+		if message := mustPanic(t, func() { RoleRateLimitEngine(quotas) }); !strings.Contains(message, "role rate limiter") {
+			t.Errorf("%s: panic %q", name, message)
+		}
+	}
+	RoleRateLimitEngine(valid())
+}
+
+func TestRoleRateLimitPicksMostGenerousQuota(t *testing.T) {
+	setupRedis(t)
+	quotas := RoleQuotas{
+		User:      RoleQuota{Requests: 3, Window: Duration(time.Minute)},
+		Anonymous: RoleQuota{Requests: 1, Window: Duration(time.Minute)},
+		Quotas: []RoleQuota{
+			{Role: "editor", Requests: 5, Window: Duration(time.Minute)},
+			// More requests, but fewer per second than editor
+			{Role: "admin", Requests: 60, Window: Duration(time.Hour)},
+			{Permission: "steps:write", Requests: 20, Window: Duration(time.Minute)},
+		},
+		StandardHeaders: true,
+	}
+	handler := RoleRateLimiter(quotas)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		name      string
+		principal *Principal
+		want      string
+	}{
+		{"anonymous", nil, `"anonymous";q=1;w=60`},
+		{"no matching quota", &Principal{ID: "u1", Roles: []string{"viewer"}}, `"user";q=3;w=60`},
+		{"role", &Principal{ID: "u2", Roles: []string{"Admin"}}, `"admin";q=60;w=3600`},
+		{"highest rate, not the most requests", &Principal{ID: "u3", Roles: []string{"admin", "editor"}}, `"editor";q=5;w=60`},
+		{"permission", &Principal{ID: "u4", Roles: []string{"editor"}, Permissions: []string{"steps:write"}}, `"steps:write";q=20;w=60`},
+	} {
+		r := httptest.NewRequest("GET", "/api/steps", nil)
+		if tc.principal != nil {
+			r = r.WithContext(WithPrincipal(r.Context(), *tc.principal))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if got := rec.Header().Get("RateLimit-Policy"); got != tc.want {
+			t.Errorf("%s: RateLimit-Policy %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mustPanic runs build and returns its panic message
+func mustPanic(t *testing.T, build func()) (message string) {
+	t.Helper()
+	defer func() {
+		message, _ = recover().(string)
+	}()
+	build()
+	t.Fatal("no panic")
+	return ""
+}
+
+func TestBurstEngineRejectsInvalidParameters(t *testing.T) {
+	for _, tc := range []struct {
+		burstSize, refillRate int
+		refillInterval        time.Duration
+	}{
+		{0, 1, time.Second},
+		{10, 0, time.Second},
+		{10, -1, time.Second},
+		{10, 2, 0},
+		{10, 2, time.Microsecond},
+	} {
+		message := mustPanic(t, func() { BurstEngine(tc.burstSize, tc.refillRate, tc.refillInterval) })
+		if !strings.Contains(message, "burst rate limiter") {
+			t.Errorf("%+v: panic %q", tc, message)
+		}
+	}
+	BurstEngine(10, 2, 30*time.Second)
+}
+
+func TestRateLimitEngineRejectsInvalidLimits(t *testing.T) {
+	for _, algorithm := range []RateLimitAlgorithm{FixedWindow, SlidingLog, SlidingWindowCounter, TokenBucket, GCRA} {
+		for _, config := range []RateLimitConfig{
+			{Requests: 0, Window: time.Minute},
+			{Requests: -5, Window: time.Minute},
+			{Requests: 10, Window: 0},
+			{Requests: 10, Window: -time.Second},
+		} {
+			config.Algorithm = algorithm
+			if message := mustPanic(t, func() { RateLimitEngine(config) }); !strings.Contains(message, "rate limiter") {
+				t.Errorf("%s %+v: panic %q", algorithm, config, message)
+			}
+		}
+	}
+}
+
+func TestCostTableEngineRejectsCostsAboveBudget(t *testing.T) {
+	for _, table := range []CostTable{
+		{Default: 11},
+		{Default: 1, Routes: []RouteCost{{Path: "/api/chat", Cost: 20}}},
+		{Default: -1},
+		{Default: 1, Routes: []RouteCost{{Path: "api/chat", Cost: 1}}},
+	} {
+		if message := mustPanic(t, func() { CostTableEngine(table, 10, time.Minute) }); !strings.Contains(message, "cost table") {
+			t.Errorf("%+v: panic %q", table, message)
+		}
+	}
+	CostTableEngine(CostTable{Default: 1, Routes: []RouteCost{{Path: "/api/chat", Cost: 10}}}, 10, time.Minute)
+}
+
+func TestCostAboveBudgetRetriesAfterWindow(t *testing.T) {
+	setupRedis(t)
+	handler := CostBasedRateLimiter(func(*http.Request) int { return 20 }, 10, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/chat", nil))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Fatalf("got %d Retry-After %q, want 429 after 60s", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimitEngineKeysOnRouteTemplate(t *testing.T) {
+	setupRedis(t)
+	handler := RateLimitMiddleware(RateLimitConfig{
+		Requests: 2,
+		Window:   time.Minute,
+		Routes:   []string{"/api/photos/{id}"},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	status := func(path string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+
+	// Different ids share the route's limit
+	for i, path := range []string{"/api/photos/1", "/api/photos/2", "/api/photos/3"} {
+		if got, want := status(path), []int{200, 200, 429}[i]; got != want {
+			t.Errorf("%s: %d, want %d", path, got, want)
+		}
+	}
+	// Other paths share one limit of their own
+	for i, path := range []string{"/api/albums", "/api/partners", "/api/sponsors"} {
+		if got, want := status(path), []int{200, 200, 429}[i]; got != want {
+			t.Errorf("%s: %d, want %d", path, got, want)
+		}
+	}
+}
+
+func TestRateLimitEngineKeysOnPathWithoutRoutes(t *testing.T) {
+	setupRedis(t)
+	handler := IPRateLimiter(1, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	status := func(path string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+
+	// Every path has a budget of its own
+	for i, path := range []string{"/api/albums", "/api/partners", "/api/albums", "/api/partners"} {
+		if got, want := status(path), []int{200, 200, 429, 429}[i]; got != want {
+			t.Errorf("request %d to %s: %d, want %d", i, path, got, want)
+		}
+	}
+}
+
+func TestBurstRateLimiter(t *testing.T) {
+	setupRedis(t)
+	handler := BurstRateLimiter(3, 1, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, want := range []int{200, 200, 200, 429} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/contact", nil))
+		if rec.Code != want {
+			t.Fatalf("request %d: %d, want %d", i, rec.Code, want)
+		}
+		if want == 429 && rec.Header().Get("Retry-After") != "60" {
+			t.Errorf("Retry-After %q, want the 60s until the next token", rec.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestGCRARateLimiter(t *testing.T) {
+	setupRedis(t)
+	handler := RateLimitMiddleware(RateLimitConfig{Requests: 2, Window: time.Minute, Algorithm: GCRA})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, want := range []int{200, 200, 429} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/photos", nil))
+		if rec.Code != want {
+			t.Fatalf("request %d: %d, want %d", i, rec.Code, want)
+		}
+		if want == 429 && rec.Header().Get("Retry-After") != "30" {
+			t.Errorf("Retry-After %q, want one emission interval of 30s", rec.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestCostTableBudgetExhaustion(t *testing.T) {
+	setupRedis(t)
+	table := CostTable{Default: 1, Routes: []RouteCost{{Path: "/api/chat", Methods: []string{"POST"}, Cost: 4}}}
+	handler := CostTableRateLimiter(table, 10, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := send("POST", "/api/chat"); rec.Code != 200 {
+			t.Fatalf("chat %d: %d", i, rec.Code)
+		}
+	}
+	// 8 of 10 spent: another chat is too expensive, a cheap request fits
+	if rec := send("POST", "/api/chat"); rec.Code != 429 || rec.Header().Get("Retry-After") != "60" || rec.Header().Get("X-RateLimit-Remaining") != "2" {
+		t.Errorf("third chat: %d Retry-After %q Remaining %q, want 429 after 60s with 2 left", rec.Code, rec.Header().Get("Retry-After"), rec.Header().Get("X-RateLimit-Remaining"))
+	}
+	if rec := send("GET", "/api/photos"); rec.Code != 200 || rec.Header().Get("X-RateLimit-Remaining") != "1" {
+		t.Errorf("cheap request: %d Remaining %q, want 200 with 1 left", rec.Code, rec.Header().Get("X-RateLimit-Remaining"))
+	}
+}
+
+func TestStandardRateLimitHeaders(t *testing.T) {
+	mr := setupRedis(t)
+	handler := RateLimitMiddleware(RateLimitConfig{Requests: 2, Window: time.Minute, StandardHeaders: true, Name: "api"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/photos", nil))
+		return rec
+	}
+
+	rec := send()
+	if policy, state := rec.Header().Get("RateLimit-Policy"), rec.Header().Get("RateLimit"); policy != `"api";q=2;w=60` || state != `"api";r=1;t=60` {
+		t.Fatalf("first request: RateLimit-Policy %q RateLimit %q", policy, state)
+	}
+
+	// The reset counts down with the window, not from the latest request
+	mr.FastForward(45 * time.Second)
+	send()
+	rec = send()
+	if rec.Code != 429 || rec.Header().Get("Retry-After") != "15" || rec.Header().Get("RateLimit") != `"api";r=0;t=15` {
+		t.Errorf("denied: %d Retry-After %q RateLimit %q, want 429 with 15s left", rec.Code, rec.Header().Get("Retry-After"), rec.Header().Get("RateLimit"))
+	}
+	reset, _ := strconv.ParseInt(rec.Header().Get("X-RateLimit-Reset"), 10, 64)
+	if left := reset - time.Now().Unix(); left < 14 || left > 16 {
+		t.Errorf("X-RateLimit-Reset %ds away, want 15s", left)
+	}
+}
+
+func TestStandardRateLimitHeadersAreOptIn(t *testing.T) {
+	setupRedis(t)
+	handler := IPRateLimiter(2, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/photos", nil))
+	if rec.Header().Get("RateLimit") != "" || rec.Header().Get("RateLimit-Policy") != "" {
+		t.Errorf("standard headers without StandardHeaders: %v", rec.Header())
+	}
+	if rec.Header().Get("X-RateLimit-Remaining") != "1" {
+		t.Errorf("X-RateLimit-Remaining %q, want 1", rec.Header().Get("X-RateLimit-Remaining"))
+	}
+}
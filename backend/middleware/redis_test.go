@@ -0,0 +1,18 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/jeffreasy/dkl25/backend/lib"
+)
+
+// setupRedis points lib at a fresh in-memory Redis for one test
+func setupRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	lib.RedisClient = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	return mr
+}
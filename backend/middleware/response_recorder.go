@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxCacheBodySize is the largest response CacheMiddleware buffers.
+// Larger responses are streamed to the client and not cached.
+const DefaultMaxCacheBodySize = 1 << 20
+
+// ResponseRecorder buffers an HTTP response so it can be cached before it is
+// sent. It stops buffering and streams straight to the client when the body
+// outgrows the limit, when the handler flushes, hijacks the connection or
+// sends an event stream. Such responses are never cached.
+type ResponseRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	body        *bytes.Buffer
+	maxBuffered int
+	passthrough bool
+}
+
+// NewResponseRecorder creates a recorder that buffers up to maxBuffered bytes
+// (DefaultMaxCacheBodySize when 0) until Finish is called
+func NewResponseRecorder(w http.ResponseWriter, maxBuffered int) *ResponseRecorder {
+	if maxBuffered <= 0 {
+		maxBuffered = DefaultMaxCacheBodySize
+	}
+	return &ResponseRecorder{
+		ResponseWriter: w,
+		statusCode:     http.StatusOK,
+		body:           &bytes.Buffer{},
+		maxBuffered:    maxBuffered,
+	}
+}
+
+// Write captures the response body, or streams it once buffering stopped
+func (r *ResponseRecorder) Write(b []byte) (int, error) {
+	if !r.passthrough && (r.body.Len()+len(b) > r.maxBuffered || r.isEventStream()) {
+		if err := r.startPassthrough(); err != nil {
+			return 0, err
+		}
+	}
+	if r.passthrough {
+		return r.ResponseWriter.Write(b)
+	}
+	return r.body.Write(b)
+}
+
+// WriteHeader captures the status code
+func (r *ResponseRecorder) WriteHeader(statusCode int) {
+	if r.passthrough {
+		r.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	// Informational responses (103 Early Hints) go out immediately
+	if statusCode < 200 {
+		r.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	r.statusCode = statusCode
+}
+
+// ReadFrom copies from src, keeping sendfile and friends for streamed bodies
+func (r *ResponseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if r.passthrough {
+		return io.Copy(r.ResponseWriter, src)
+	}
+	// Hide ReadFrom so io.Copy goes through Write and the buffer limit
+	return io.Copy(struct{ io.Writer }{r}, src)
+}
+
+// Flush sends what was buffered and switches to streaming, so handlers that
+// flush (server-sent events, long polls) keep working behind the cache
+func (r *ResponseRecorder) Flush() {
+	r.FlushError()
+}
+
+// FlushError is Flush for http.ResponseController
+func (r *ResponseRecorder) FlushError() error {
+	if err := r.startPassthrough(); err != nil {
+		return err
+	}
+	return http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Hijack hands the connection to the handler (WebSocket upgrades)
+func (r *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil {
+		r.passthrough = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (r *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Buffered reports whether the whole response is still in the buffer and
+// can therefore be cached
+func (r *ResponseRecorder) Buffered() bool {
+	return !r.passthrough
+}
+
+// StatusCode returns the recorded status code
+func (r *ResponseRecorder) StatusCode() int {
+	return r.statusCode
+}
+
+// Body returns the buffered body
+func (r *ResponseRecorder) Body() []byte {
+	return r.body.Bytes()
+}
+
+// Finish sends the recorded status code and body to the client if they were
+// not streamed already
+func (r *ResponseRecorder) Finish() {
+	if r.passthrough {
+		return
+	}
+	r.ResponseWriter.WriteHeader(r.statusCode)
+	r.ResponseWriter.Write(r.body.Bytes())
+	r.passthrough = true
+}
+
+// startPassthrough writes the status and buffered body and stops buffering
+func (r *ResponseRecorder) startPassthrough() error {
+	if r.passthrough {
+		return nil
+	}
+	r.passthrough = true
+	r.ResponseWriter.WriteHeader(r.statusCode)
+	if r.body.Len() > 0 {
+		if _, err := r.ResponseWriter.Write(r.body.Bytes()); err != nil {
+			return err
+		}
+		r.body.Reset()
+	}
+	return nil
+}
+
+// isEventStream reports whether the handler is sending server-sent events
+func (r *ResponseRecorder) isEventStream() bool {
+	return strings.HasPrefix(r.Header().Get("Content-Type"), "text/event-stream")
+}
+
+// isStreamingRequest reports whether a request asks for a connection upgrade
+// (WebSocket) or an event stream, which must never go through the cache
+func isStreamingRequest(x Exchange) bool {
+	if x.Header("Upgrade") != "" {
+		return true
+	}
+	for _, token := range strings.Split(x.Header("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true
+		}
+	}
+	return strings.Contains(x.Header("Accept"), "text/event-stream")
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseRecorderStreamsPastSizeCap(t *testing.T) {
+	rec := httptest.NewRecorder()
+	recorder := NewResponseRecorder(rec, 8)
+	recorder.WriteHeader(http.StatusCreated)
+	recorder.Write([]byte("12345"))
+	if !recorder.Buffered() || rec.Body.Len() != 0 {
+		t.Fatalf("under the cap: buffered %v, sent %q", recorder.Buffered(), rec.Body)
+	}
+
+	recorder.Write([]byte("67890"))
+	recorder.Finish()
+	if recorder.Buffered() || rec.Code != http.StatusCreated || rec.Body.String() != "1234567890" {
+		t.Errorf("over the cap: buffered %v, sent %d %q", recorder.Buffered(), rec.Code, rec.Body)
+	}
+}
+
+func TestResponseRecorderFlushStartsStreaming(t *testing.T) {
+	rec := httptest.NewRecorder()
+	recorder := NewResponseRecorder(rec, 0)
+	recorder.Write([]byte("data: 1\n\n"))
+	if err := http.NewResponseController(recorder).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Buffered() || !rec.Flushed || rec.Body.String() != "data: 1\n\n" {
+		t.Fatalf("after Flush: buffered %v, flushed %v, sent %q", recorder.Buffered(), rec.Flushed, rec.Body)
+	}
+
+	recorder.Write([]byte("data: 2\n\n"))
+	if rec.Body.String() != "data: 1\n\ndata: 2\n\n" {
+		t.Errorf("later writes not streamed: %q", rec.Body)
+	}
+}
+
+func TestResponseRecorderPassesEventStreams(t *testing.T) {
+	rec := httptest.NewRecorder()
+	recorder := NewResponseRecorder(rec, 0)
+	recorder.Header().Set("Content-Type", "text/event-stream")
+	recorder.Write([]byte("data: 1\n\n"))
+	if recorder.Buffered() || rec.Body.String() != "data: 1\n\n" {
+		t.Errorf("event stream buffered: %v, sent %q", recorder.Buffered(), rec.Body)
+	}
+}
+
+func TestResponseRecorderHijack(t *testing.T) {
+	// httptest.ResponseRecorder cannot be hijacked; the recorder keeps buffering
+	recorder := NewResponseRecorder(httptest.NewRecorder(), 0)
+	if _, _, err := recorder.Hijack(); err == nil || !recorder.Buffered() {
+		t.Errorf("failed hijack: err %v, buffered %v", err, recorder.Buffered())
+	}
+
+	hijacked := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := NewResponseRecorder(w, 0)
+		conn, rw, err := http.NewResponseController(recorder).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		hijacked <- !recorder.Buffered()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	if status, _ := bufio.NewReader(conn).ReadString('\n'); !strings.Contains(status, "101") {
+		t.Errorf("status line %q, want 101", status)
+	}
+	if !<-hijacked {
+		t.Error("recorder still buffering after a hijack")
+	}
+}
+
+func TestCacheSkipsStreamedResponses(t *testing.T) {
+	mr := setupRedis(t)
+	handler := CacheMiddleware(CacheConfig{TTL: time.Minute, Prefix: "test", MaxBodySize: 16})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/big":
+			w.Write([]byte(`"` + strings.Repeat("a", 30) + `"`))
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: {}\n\n"))
+		case "/flushed":
+			w.Write([]byte(`[1]`))
+			http.NewResponseController(w).Flush()
+		}
+	}))
+
+	for _, path := range []string{"/big", "/events", "/flushed"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+			t.Errorf("%s: %d %q", path, rec.Code, rec.Body)
+		}
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("streamed responses were cached: %v", keys)
+	}
+}